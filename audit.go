@@ -0,0 +1,42 @@
+package imigrate
+
+import (
+	"os"
+	"os/user"
+	"time"
+)
+
+// auditColumns are added to the migrations table to record how each
+// migration was applied.
+var auditColumns = []struct {
+	name       string
+	columnType string
+}{
+	{"name", "varchar(255)"},
+	{"file", "varchar(255)"},
+	{"duration_ms", "bigint"},
+	{"applied_by", "varchar(255)"},
+	{"build_id", "varchar(255)"},
+}
+
+// defaultAppliedBy returns user@hostname, leaving out what can't be found.
+func defaultAppliedBy() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		return name
+	}
+	return name + "@" + host
+}
+
+// recordArgs returns the arguments for insertVersionSQL.
+func (o IMigrator) recordArgs(m Migration, baseline bool, d time.Duration) []interface{} {
+	var b int
+	if baseline {
+		b = 1
+	}
+	return []interface{}{m.Version, m.Checksum(), b, m.Name, m.fileName(), d.Milliseconds(), o.AppliedBy, o.BuildID}
+}
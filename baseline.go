@@ -0,0 +1,45 @@
+package imigrate
+
+import (
+	"context"
+	"fmt"
+)
+
+// Baseline records every migration up to and including version as applied
+// without running its SQL, for databases built before imigrate was adopted.
+// The recorded versions are marked so Status can show them. version must be
+// the version of a migration.
+func (o *IMigrator) Baseline(version int64) error {
+	return o.BaselineContext(context.Background(), version)
+}
+
+// BaselineContext is like Baseline but stops with the context's error once
+// ctx is done.
+func (o *IMigrator) BaselineContext(ctx context.Context, version int64) error {
+	return o.run(ctx, func(applied map[int64]bool) error {
+		if !o.hasVersion(version) {
+			return newError(PhasePlan, nil, fmt.Errorf("%w: %d", ErrUnknownVersion, version))
+		}
+		o.sortAscending()
+		for _, m := range o.Migrations {
+			if m.Version > version || applied[m.Version] {
+				continue
+			}
+			if o.DryRun {
+				m.UpFunc, m.DnFunc = nil, nil
+				o.printDryRun("baseline", m, "", o.insertVersionSQL(), o.recordArgs(m, true, 0)...)
+				applied[m.Version] = true
+				continue
+			}
+			if _, err := o.db().ExecContext(ctx, o.insertVersionSQL(), o.recordArgs(m, true, 0)...); err != nil {
+				err = newError(PhaseRecord, &m, err)
+				o.appendHistory(m, DirectionBaseline, 0, err)
+				return err
+			}
+			o.appendHistory(m, DirectionBaseline, 0, nil)
+			applied[m.Version] = true
+			o.log().Info("Baseline recorded", migrationAttrs(m, DirectionBaseline)...)
+		}
+		return nil
+	})
+}
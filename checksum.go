@@ -0,0 +1,104 @@
+package imigrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Checksum returns the hex encoded SHA-256 of the UP and DOWN SQL.
+func (o Migration) Checksum() string {
+	h := sha256.New()
+	h.Write([]byte(o.Up))
+	h.Write([]byte{0})
+	h.Write([]byte(o.Dn))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getChecksums returns the recorded checksum of every applied version. It
+// returns nil when the DB is not a RowGetter. Versions applied before
+// checksums were recorded have an empty checksum.
+func (o IMigrator) getChecksums(ctx context.Context) (map[int64]string, error) {
+	rg, ok := o.DB.(RowGetter)
+	if !ok {
+		return nil, nil
+	}
+	rows, err := rg.GetRows(ctx, fmt.Sprintf("SELECT %s, %s FROM %s", o.column(), o.dialect().QuoteIdent(o.ChecksumColumn), o.table()))
+	if err != nil {
+		return nil, newError(PhaseVerify, nil, err)
+	}
+	checksums := make(map[int64]string, len(rows))
+	for _, row := range rows {
+		v, err := strconv.ParseInt(row[0], 10, 64)
+		if err != nil {
+			return nil, newError(PhaseVerify, nil, err)
+		}
+		checksums[v] = row[1]
+	}
+	return checksums, nil
+}
+
+// verifyChecksums returns the applied versions whose file no longer matches
+// the recorded checksum.
+func (o IMigrator) verifyChecksums(ctx context.Context) ([]int64, error) {
+	checksums, err := o.getChecksums(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var mismatches []int64
+	o.sortAscending()
+	for _, m := range o.Migrations {
+		if sum := checksums[m.Version]; sum != "" && sum != m.Checksum() {
+			mismatches = append(mismatches, m.Version)
+		}
+	}
+	return mismatches, nil
+}
+
+// checkChecksums logs checksum mismatches, or fails with ErrChecksumMismatch
+// when StrictChecksums is set. StrictChecksums also fails when the DB can't
+// read checksums back, rather than letting edits through unchecked.
+func (o IMigrator) checkChecksums(ctx context.Context) error {
+	if _, ok := o.DB.(RowGetter); !ok && o.StrictChecksums {
+		return newError(PhaseVerify, nil, errors.New("StrictChecksums requires a DB that implements RowGetter"))
+	}
+	mismatches, err := o.verifyChecksums(ctx)
+	if err != nil || len(mismatches) == 0 {
+		return err
+	}
+	if o.StrictChecksums {
+		return newError(PhaseVerify, nil, fmt.Errorf("%w: %v", ErrChecksumMismatch, mismatches))
+	}
+	for _, v := range mismatches {
+		o.log().Warn("Checksum mismatch", "version", v)
+	}
+	return nil
+}
+
+// Repair records the current checksum of every applied migration, accepting
+// any edits made to their files since they were applied.
+func (o *IMigrator) Repair() error {
+	return o.RepairContext(context.Background())
+}
+
+// RepairContext is like Repair but stops with the context's error once ctx is
+// done.
+func (o *IMigrator) RepairContext(ctx context.Context) error {
+	return o.run(ctx, func(applied map[int64]bool) error {
+		d := o.dialect()
+		query := fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s = %s", o.table(), d.QuoteIdent(o.ChecksumColumn), d.Placeholder(1), o.column(), d.Placeholder(2))
+		for _, m := range o.Migrations {
+			if !applied[m.Version] {
+				continue
+			}
+			if _, err := o.db().ExecContext(ctx, query, m.Checksum(), m.Version); err != nil {
+				return newError(PhaseRecord, &m, err)
+			}
+			o.log().Info("Checksum recorded", "version", m.Version, "file", m.fileName())
+		}
+		return nil
+	})
+}
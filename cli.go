@@ -1,96 +1,378 @@
 package imigrate
 
 import (
+	"context"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"time"
 )
 
 // HelpText is printed when no command is specified.
-const HelpText = "Please specify up, down, redo, rollback, status, or create."
+const HelpText = "Please specify up, down, redo, rollback, goto, status, history, repair, forget, force, validate, baseline, or create."
 
 // CLIErr is returned when no command is specified.
 var CLIErr error = errors.New(HelpText)
 
+// ErrGotoVersion is returned when goto is run without a version.
+var ErrGotoVersion = errors.New("goto requires -version")
+
+// ErrForgetVersion is returned when forget is run without a version.
+var ErrForgetVersion = errors.New("forget requires -version")
+
+// ErrBaselineVersion is returned when baseline is run without a version.
+var ErrBaselineVersion = errors.New("baseline requires -version")
+
+// ErrForceArgs is returned when force is run without a version or with a
+// state other than applied or pending.
+var ErrForceArgs = errors.New("force requires -version and -state=applied or -state=pending")
+
+// ErrUnsupported is wrapped by the error returned when the migrator doesn't
+// implement the optional interface a command needs, such as GotoMigrator.
+var ErrUnsupported = errors.New("command not supported by the migrator")
+
+// ErrHistoryTime is returned when history is run with a -since or -until it
+// can't parse.
+var ErrHistoryTime = errors.New("history -since and -until take a date like 2006-01-02 or 2006-01-02T15:04:05")
+
+// Output receives the status report in the json and table formats. The text
+// format is written to Logger.
+var Output io.Writer = os.Stdout
+
+// Options holds the CLI flags that change how a command runs rather than
+// which migrations it selects.
+type Options struct {
+	NoLock          bool // Skip the migration lock.
+	DryRun          bool // Print the SQL instead of running it.
+	AllowOutOfOrder bool // Apply pending migrations older than the newest applied one.
+	Force           bool // Remove the version of irreversible migrations without running DOWN.
+	Verbose         bool // Log debug messages.
+	Silent          bool // Log nothing.
+}
+
+// Configurer is implemented by migrators that accept Options. CLI calls
+// Configure with the parsed flags before running a command.
+type Configurer interface {
+	Configure(Options)
+}
+
 // CLI parses os.Args and runs the appropriate migration command.
-// Commands available are up, down, redo, rollback, status, and create.
+// Commands available are up, down, redo, rollback, goto, status, history,
+// repair, forget, force, validate, baseline, and create.
 // Most commands accept a "steps" flag which is parsed as an int. Use -steps=1
 // to set it.  Up, down, and redo accept a "version" flag which is parsed as
-// int64. Use --version=1610069160 to set it.
+// int64. Use --version=1610069160 to set it. Goto requires the "version" flag
+// and migrates up or down to that version. Forget requires the "version" flag
+// and removes that applied version when its migration file is missing.
+// Baseline requires the "version" flag and records every migration up to that
+// version as applied without running it. Force requires the "version" flag
+// and a "state" flag of applied or pending, and records that version in that
+// state, clearing its dirty mark, without running it.
+// Validate logs every migration file that can't be loaded and returns an error
+// wrapping ErrInvalidMigration if there are any.
+//
+// Goto, history, repair, forget, force, validate and baseline need the
+// migrator to implement the matching optional interface, such as
+// GotoMigrator. Otherwise they return an error wrapping ErrUnsupported.
+//
+// Status and history accept a "format" flag of text, json or table. Text is
+// written to Logger, json and table to Output. History accepts a "version"
+// flag to list the changes to one version, and "since" and "until" flags of
+// a date or time, like 2021-01-08 or 2021-01-08T15:04:05, to list the changes
+// in that range.
+//
+// Every command accepts a "silent" flag to discard log messages and a
+// "verbose" flag to log debug messages too. They reach the migrator through
+// Options, so only Configurers honor them. Up, down, redo, rollback, goto,
+// forget, force and baseline accept a "no-lock" flag to skip the migration
+// lock and a "dry-run" flag to print the SQL they would run. Up and goto
+// accept an "allow-out-of-order" flag to apply pending migrations older than
+// the newest applied one. Down, rollback and goto accept a "force" flag to
+// remove the version of irreversible migrations without running their DOWN
+// SQL.
+//
+// The error returned by the migrator is returned unchanged, so callers can
+// exit with a non-zero status:
+//
+//	if err := imigrate.CLI(migrator); err != nil {
+//		log.Fatal(err)
+//	}
 func CLI(migrator Migrator) error {
-	runners := make(map[string]func())
+	return CLIContext(context.Background(), migrator)
+}
+
+// CLIContext is like CLI but passes ctx to migrators that implement
+// ContextMigrator, so a deadline or a signal can abort a run:
+//
+//	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+//	defer stop()
+//	err := imigrate.CLIContext(ctx, migrator)
+func CLIContext(ctx context.Context, migrator Migrator) error {
+	runners := make(map[string]func() error)
+	cm := asContextMigrator(migrator)
+	// logger receives the messages and text reports of CLI itself.
+	logger := Logger
 
 	upCmd := flag.NewFlagSet("up", flag.ContinueOnError)
 	upSteps := upCmd.Int("steps", -1, "how many migrations to execute forward")
 	upVersion := upCmd.Int64("version", 0, "which version to migrate")
-	runners[upCmd.Name()] = func() {
-		migrator.Up(*upSteps, *upVersion)
+	runners[upCmd.Name()] = func() error {
+		return cm.UpContext(ctx, *upSteps, *upVersion)
 	}
 
 	dnCmd := flag.NewFlagSet("down", flag.ContinueOnError)
 	dnSteps := dnCmd.Int("steps", -1, "how many migrations to execute backward")
 	dnVersion := dnCmd.Int64("version", 0, "which version to migrate")
-	runners[dnCmd.Name()] = func() {
-		migrator.Down(*dnSteps, *dnVersion)
+	runners[dnCmd.Name()] = func() error {
+		return cm.DownContext(ctx, *dnSteps, *dnVersion)
 	}
 
 	redoCmd := flag.NewFlagSet("redo", flag.ContinueOnError)
 	redoSteps := redoCmd.Int("steps", 1, "how many migrations to redo")
 	redoVersion := redoCmd.Int64("version", 0, "which version to migrate")
-	runners[redoCmd.Name()] = func() {
-		migrator.Redo(*redoSteps, *redoVersion)
+	runners[redoCmd.Name()] = func() error {
+		return cm.RedoContext(ctx, *redoSteps, *redoVersion)
 	}
 
 	rollbackCmd := flag.NewFlagSet("rollback", flag.ContinueOnError)
 	rollbackSteps := rollbackCmd.Int("steps", 1, "how many migrations to rollback")
-	runners[rollbackCmd.Name()] = func() {
-		migrator.Rollback(*rollbackSteps)
+	runners[rollbackCmd.Name()] = func() error {
+		return cm.RollbackContext(ctx, *rollbackSteps)
+	}
+
+	gotoCmd := flag.NewFlagSet("goto", flag.ContinueOnError)
+	gotoVersion := gotoCmd.Int64("version", -1, "which version to migrate to, 0 reverts every migration")
+	runners[gotoCmd.Name()] = func() error {
+		if *gotoVersion < 0 {
+			return ErrGotoVersion
+		}
+		gm, ok := migrator.(GotoMigrator)
+		if !ok {
+			return unsupported(gotoCmd)
+		}
+		return gm.GotoContext(ctx, *gotoVersion)
 	}
 
 	statusCmd := flag.NewFlagSet("status", flag.ContinueOnError)
-	runners[statusCmd.Name()] = func() {
-		migrator.Status()
+	statusFormat := statusCmd.String("format", "text", "output format: text, json or table")
+	runners[statusCmd.Name()] = func() error {
+		write, err := reportWriter(*statusFormat, logger)
+		if err != nil {
+			return err
+		}
+		report, err := cm.StatusContext(ctx)
+		if err != nil {
+			return err
+		}
+		if report == nil {
+			report = &StatusReport{Migrations: []MigrationStatus{}}
+		}
+		return write(report)
 	}
 
-	createCmd := flag.NewFlagSet("create", flag.ContinueOnError)
-	runners[createCmd.Name()] = func() {
-		migrator.Create(createCmd.Arg(0))
+	historyCmd := flag.NewFlagSet("history", flag.ContinueOnError)
+	historyFormat := historyCmd.String("format", "text", "output format: text, json or table")
+	historyVersion := historyCmd.Int64("version", 0, "only list changes to this version")
+	historySince := historyCmd.String("since", "", "only list changes at or after this time, in the database's time zone")
+	historyUntil := historyCmd.String("until", "", "only list changes before this time, in the database's time zone")
+	runners[historyCmd.Name()] = func() error {
+		hm, ok := migrator.(HistoryMigrator)
+		if !ok {
+			return unsupported(historyCmd)
+		}
+		write, err := reportWriter(*historyFormat, logger)
+		if err != nil {
+			return err
+		}
+		filter := HistoryFilter{Version: *historyVersion}
+		if filter.Since, err = parseHistoryTime(*historySince); err != nil {
+			return err
+		}
+		if filter.Until, err = parseHistoryTime(*historyUntil); err != nil {
+			return err
+		}
+		report, err := hm.HistoryContext(ctx, filter)
+		if err != nil {
+			return err
+		}
+		if report == nil {
+			report = &HistoryReport{Entries: []HistoryEntry{}}
+		}
+		return write(report)
 	}
 
-	silentFlag := flag.Bool("silent", false, "Do not print messages")
+	repairCmd := flag.NewFlagSet("repair", flag.ContinueOnError)
+	runners[repairCmd.Name()] = func() error {
+		rm, ok := migrator.(RepairMigrator)
+		if !ok {
+			return unsupported(repairCmd)
+		}
+		return rm.RepairContext(ctx)
+	}
+
+	forgetCmd := flag.NewFlagSet("forget", flag.ContinueOnError)
+	forgetVersion := forgetCmd.Int64("version", 0, "which applied version to forget")
+	runners[forgetCmd.Name()] = func() error {
+		if *forgetVersion <= 0 {
+			return ErrForgetVersion
+		}
+		fm, ok := migrator.(ForgetMigrator)
+		if !ok {
+			return unsupported(forgetCmd)
+		}
+		return fm.ForgetContext(ctx, *forgetVersion)
+	}
+
+	baselineCmd := flag.NewFlagSet("baseline", flag.ContinueOnError)
+	baselineVersion := baselineCmd.Int64("version", 0, "the newest version already present in the database")
+	runners[baselineCmd.Name()] = func() error {
+		if *baselineVersion <= 0 {
+			return ErrBaselineVersion
+		}
+		bm, ok := migrator.(BaselineMigrator)
+		if !ok {
+			return unsupported(baselineCmd)
+		}
+		return bm.BaselineContext(ctx, *baselineVersion)
+	}
+
+	forceCmd := flag.NewFlagSet("force", flag.ContinueOnError)
+	forceVersion := forceCmd.Int64("version", 0, "which version to record")
+	forceState := forceCmd.String("state", "", "the state to record: applied or pending")
+	runners[forceCmd.Name()] = func() error {
+		state := MigrationState(*forceState)
+		if *forceVersion <= 0 || (state != StateApplied && state != StatePending) {
+			return ErrForceArgs
+		}
+		fm, ok := migrator.(ForceMigrator)
+		if !ok {
+			return unsupported(forceCmd)
+		}
+		return fm.ForceStateContext(ctx, *forceVersion, state)
+	}
+
+	validateCmd := flag.NewFlagSet("validate", flag.ContinueOnError)
+	runners[validateCmd.Name()] = func() error {
+		vm, ok := migrator.(ValidateMigrator)
+		if !ok {
+			return unsupported(validateCmd)
+		}
+		rejected, err := vm.Validate()
+		if err != nil {
+			return err
+		}
+		for _, r := range rejected {
+			logger.Println("Rejected", r)
+		}
+		if len(rejected) > 0 {
+			return fmt.Errorf("%w: %d rejected", ErrInvalidMigration, len(rejected))
+		}
+		logger.Println("All migration files are valid")
+		return nil
+	}
+
+	createCmd := flag.NewFlagSet("create", flag.ContinueOnError)
+	runners[createCmd.Name()] = func() error {
+		return migrator.Create(createCmd.Arg(0))
+	}
 
 	commands := []*flag.FlagSet{
 		upCmd,
 		dnCmd,
 		redoCmd,
 		rollbackCmd,
+		gotoCmd,
 		statusCmd,
+		historyCmd,
+		repairCmd,
+		forgetCmd,
+		forceCmd,
+		baselineCmd,
+		validateCmd,
 		createCmd,
 	}
 
+	var opts Options
+	for _, cmd := range commands {
+		cmd.BoolVar(&opts.Silent, "silent", false, "Do not print messages")
+		cmd.BoolVar(&opts.Verbose, "verbose", false, "print debug messages")
+	}
+	for _, cmd := range []*flag.FlagSet{upCmd, dnCmd, redoCmd, rollbackCmd, gotoCmd, forgetCmd, forceCmd, baselineCmd} {
+		cmd.BoolVar(&opts.NoLock, "no-lock", false, "do not take the migration lock")
+		cmd.BoolVar(&opts.DryRun, "dry-run", false, "print the SQL instead of running it")
+	}
+	for _, cmd := range []*flag.FlagSet{upCmd, gotoCmd} {
+		cmd.BoolVar(&opts.AllowOutOfOrder, "allow-out-of-order", false, "apply pending migrations older than the newest applied one")
+	}
+	for _, cmd := range []*flag.FlagSet{dnCmd, rollbackCmd, gotoCmd} {
+		cmd.BoolVar(&opts.Force, "force", false, "remove the version of irreversible migrations without running DOWN")
+	}
+
 	if len(os.Args) < 2 {
 		return CLIErr
 	}
 
-	commandFound := false
 	for _, cmd := range commands {
 		if os.Args[1] == cmd.Name() {
-			commandFound = true
 			err := cmd.Parse(os.Args[2:])
 			if err == flag.ErrHelp {
 				return nil
 			}
+			if err != nil {
+				return err
+			}
 
-			if *silentFlag {
-				Logger = DiscardLogger
+			if opts.Silent {
+				logger = DiscardLogger
 			}
-			runners[cmd.Name()]()
+			if c, ok := migrator.(Configurer); ok {
+				c.Configure(opts)
+			}
+			return runners[cmd.Name()]()
 		}
 	}
 
-	if !commandFound {
-		return CLIErr
+	return CLIErr
+}
+
+func unsupported(cmd *flag.FlagSet) error {
+	return fmt.Errorf("%w: %s", ErrUnsupported, cmd.Name())
+}
+
+// parseHistoryTime parses a -since or -until flag. An empty flag is the zero
+// time, which doesn't filter.
+func parseHistoryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04:05", historyTimeFormat} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
 	}
+	return time.Time{}, fmt.Errorf("%w: %q", ErrHistoryTime, s)
+}
+
+// report is implemented by StatusReport and HistoryReport.
+type report interface {
+	WriteText(io.Writer) error
+	WriteJSON(io.Writer) error
+	WriteTable(io.Writer) error
+}
 
-	return nil
+// reportWriter returns a function that writes a report in format. Text is
+// written to logger.
+func reportWriter(format string, logger *log.Logger) (func(report) error, error) {
+	switch format {
+	case "text":
+		return func(r report) error { return r.WriteText(logger.Writer()) }, nil
+	case "json":
+		return func(r report) error { return r.WriteJSON(Output) }, nil
+	case "table":
+		return func(r report) error { return r.WriteTable(Output) }, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
 }
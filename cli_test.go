@@ -1,9 +1,15 @@
 package imigrate
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"testing"
+	"time"
 )
 
 type commandData struct {
@@ -14,34 +20,102 @@ type commandData struct {
 }
 
 type TestingMigrator struct {
+	err      error
+	rejected []Rejection
 }
 
 var data commandData
+var historyFilter HistoryFilter
+var forcedState MigrationState
+var configured Options
 
-func (o TestingMigrator) Create(name string) {
+func (o TestingMigrator) Configure(opts Options) {
+	configured = opts
+}
+
+func (o TestingMigrator) Create(name string) error {
 	data.command = "create"
 	data.newName = name
+	return o.err
 }
-func (o TestingMigrator) Up(steps int, version int64) {
+func (o TestingMigrator) Up(steps int, version int64) error {
 	data.command = "up"
 	data.steps = steps
 	data.version = version
+	return o.err
 }
-func (o TestingMigrator) Down(steps int, version int64) {
+func (o TestingMigrator) Down(steps int, version int64) error {
 	data.command = "down"
 	data.steps = steps
 	data.version = version
+	return o.err
 }
-func (o TestingMigrator) Redo(steps int, version int64) {
+func (o TestingMigrator) Redo(steps int, version int64) error {
 	data.command = "redo"
 	data.steps = steps
+	return o.err
 }
-func (o TestingMigrator) Rollback(steps int) {
+func (o TestingMigrator) Rollback(steps int) error {
 	data.command = "rollback"
 	data.steps = steps
+	return o.err
 }
-func (o TestingMigrator) Status() {
+func (o TestingMigrator) Goto(version int64) error {
+	data.command = "goto"
+	data.version = version
+	return o.err
+}
+func (o TestingMigrator) Status() (*StatusReport, error) {
 	data.command = "status"
+	return nil, o.err
+}
+func (o TestingMigrator) History(filter HistoryFilter) (*HistoryReport, error) {
+	data.command = "history"
+	data.version = filter.Version
+	historyFilter = filter
+	return nil, o.err
+}
+func (o TestingMigrator) Repair() error {
+	data.command = "repair"
+	return o.err
+}
+func (o TestingMigrator) Forget(version int64) error {
+	data.command = "forget"
+	data.version = version
+	return o.err
+}
+func (o TestingMigrator) Baseline(version int64) error {
+	data.command = "baseline"
+	data.version = version
+	return o.err
+}
+func (o TestingMigrator) ForceState(version int64, state MigrationState) error {
+	data.command = "force"
+	data.version = version
+	forcedState = state
+	return o.err
+}
+func (o TestingMigrator) Validate() ([]Rejection, error) {
+	data.command = "validate"
+	return o.rejected, o.err
+}
+func (o TestingMigrator) GotoContext(ctx context.Context, version int64) error {
+	return o.Goto(version)
+}
+func (o TestingMigrator) HistoryContext(ctx context.Context, filter HistoryFilter) (*HistoryReport, error) {
+	return o.History(filter)
+}
+func (o TestingMigrator) RepairContext(ctx context.Context) error {
+	return o.Repair()
+}
+func (o TestingMigrator) ForgetContext(ctx context.Context, version int64) error {
+	return o.Forget(version)
+}
+func (o TestingMigrator) BaselineContext(ctx context.Context, version int64) error {
+	return o.Baseline(version)
+}
+func (o TestingMigrator) ForceStateContext(ctx context.Context, version int64, state MigrationState) error {
+	return o.ForceState(version, state)
 }
 
 func TestCLIArgs(t *testing.T) {
@@ -57,6 +131,15 @@ func TestCLIArgs(t *testing.T) {
 		{[]string{"cli", "redo", "-steps=3"}, commandData{"redo", 3, 0, ""}},
 		{[]string{"cli", "rollback", "-steps=4"}, commandData{"rollback", 4, 0, ""}},
 		{[]string{"cli", "status", "new_table"}, commandData{"status", 0, 0, ""}},
+		{[]string{"cli", "repair"}, commandData{"repair", 0, 0, ""}},
+		{[]string{"cli", "history", "-format=table"}, commandData{"history", 0, 0, ""}},
+		{[]string{"cli", "history", "-version=1610069160"}, commandData{"history", 0, 1610069160, ""}},
+		{[]string{"cli", "validate"}, commandData{"validate", 0, 0, ""}},
+		{[]string{"cli", "baseline", "-version=1610069160"}, commandData{"baseline", 0, 1610069160, ""}},
+		{[]string{"cli", "goto", "-version=1610069160"}, commandData{"goto", 0, 1610069160, ""}},
+		{[]string{"cli", "goto", "-version=0"}, commandData{"goto", 0, 0, ""}},
+		{[]string{"cli", "forget", "-version=1610069160"}, commandData{"forget", 0, 1610069160, ""}},
+		{[]string{"cli", "force", "-version=1610069160", "-state=pending"}, commandData{"force", 0, 1610069160, ""}},
 		{[]string{"cli", "up", "-version=1610069160"}, commandData{"up", -1, 1610069160, ""}},
 		{[]string{"cli", "down", "-version=1610069160"}, commandData{"down", -1, 1610069160, ""}},
 	}
@@ -72,3 +155,165 @@ func TestCLIArgs(t *testing.T) {
 		})
 	}
 }
+
+func TestCLIReturnsMigratorError(t *testing.T) {
+	migErr := &MigrationError{Phase: PhaseUp, Version: 1610069160, Err: errors.New("boom")}
+	mig := TestingMigrator{err: migErr}
+	os.Args = []string{"cli", "up", "-silent"}
+	err := CLI(mig)
+	var got *MigrationError
+	if !errors.As(err, &got) || got.Version != 1610069160 {
+		t.Fatalf("expected migration error, got %v", err)
+	}
+	os.Args = []string{"cli"}
+	if err := CLI(mig); err != CLIErr {
+		t.Fatalf("expected CLIErr, got %v", err)
+	}
+	os.Args = []string{"cli", "goto"}
+	if err := CLI(mig); err != ErrGotoVersion {
+		t.Fatalf("expected ErrGotoVersion, got %v", err)
+	}
+	os.Args = []string{"cli", "forget"}
+	if err := CLI(mig); err != ErrForgetVersion {
+		t.Fatalf("expected ErrForgetVersion, got %v", err)
+	}
+	os.Args = []string{"cli", "baseline"}
+	if err := CLI(mig); err != ErrBaselineVersion {
+		t.Fatalf("expected ErrBaselineVersion, got %v", err)
+	}
+	for _, args := range [][]string{{"cli", "force", "-state=applied"}, {"cli", "force", "-version=1610069160"}, {"cli", "force", "-version=1610069160", "-state=dirty"}} {
+		os.Args = args
+		if err := CLI(mig); err != ErrForceArgs {
+			t.Fatalf("expected ErrForceArgs for %v, got %v", args, err)
+		}
+	}
+	os.Args = []string{"cli", "validate", "-silent"}
+	mig = TestingMigrator{rejected: []Rejection{{File: "notes.txt", Reason: RejectNoVersion}}}
+	if err := CLI(mig); !errors.Is(err, ErrInvalidMigration) {
+		t.Fatalf("expected ErrInvalidMigration, got %v", err)
+	}
+}
+
+// PlainMigrator implements Migrator and none of the optional interfaces.
+type PlainMigrator struct {
+	Migrator
+}
+
+func TestCLIUnsupported(t *testing.T) {
+	for _, args := range [][]string{
+		{"cli", "goto", "-version=1610069160"},
+		{"cli", "history"},
+		{"cli", "repair"},
+		{"cli", "forget", "-version=1610069160"},
+		{"cli", "force", "-version=1610069160", "-state=applied"},
+		{"cli", "validate"},
+		{"cli", "baseline", "-version=1610069160"},
+	} {
+		os.Args = args
+		if err := CLI(PlainMigrator{TestingMigrator{}}); !errors.Is(err, ErrUnsupported) {
+			t.Fatalf("%v: expected ErrUnsupported, got %v", args, err)
+		}
+	}
+	os.Args = []string{"cli", "up", "-steps=1"}
+	data = commandData{}
+	check(CLI(PlainMigrator{TestingMigrator{}}))
+	if data.command != "up" || data.steps != 1 {
+		t.Fatalf("expected up to run, got %#v", data)
+	}
+}
+
+type TestingContextMigrator struct {
+	TestingMigrator
+}
+
+func (o TestingContextMigrator) UpContext(ctx context.Context, steps int, version int64) error {
+	data.command = "up-context"
+	data.steps = steps
+	data.version = version
+	return ctx.Err()
+}
+func (o TestingContextMigrator) DownContext(ctx context.Context, steps int, version int64) error {
+	return o.Down(steps, version)
+}
+func (o TestingContextMigrator) RedoContext(ctx context.Context, steps int, version int64) error {
+	return o.Redo(steps, version)
+}
+func (o TestingContextMigrator) RollbackContext(ctx context.Context, steps int) error {
+	return o.Rollback(steps)
+}
+func (o TestingContextMigrator) StatusContext(ctx context.Context) (*StatusReport, error) {
+	return o.Status()
+}
+
+func TestCLIContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	os.Args = []string{"cli", "up", "-steps=2"}
+	data = commandData{}
+	err := CLIContext(ctx, TestingContextMigrator{})
+	if err != context.Canceled || data.command != "up-context" || data.steps != 2 {
+		t.Fatalf("expected cancelled up-context run, got %v %#v", err, data)
+	}
+}
+
+func TestCLIOptions(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected Options
+	}{
+		{[]string{"cli", "up"}, Options{}},
+		{[]string{"cli", "up", "-no-lock"}, Options{NoLock: true}},
+		{[]string{"cli", "rollback", "-no-lock"}, Options{NoLock: true}},
+		{[]string{"cli", "redo", "-dry-run"}, Options{DryRun: true}},
+		{[]string{"cli", "up", "-allow-out-of-order"}, Options{AllowOutOfOrder: true}},
+		{[]string{"cli", "rollback", "-force"}, Options{Force: true}},
+		{[]string{"cli", "goto", "-version=0", "-force"}, Options{Force: true}},
+		{[]string{"cli", "status", "-verbose"}, Options{Verbose: true}},
+		{[]string{"cli", "repair", "-silent"}, Options{Silent: true}},
+	}
+	for _, tt := range tests {
+		configured = Options{}
+		os.Args = tt.args
+		check(CLI(TestingMigrator{}))
+		if configured != tt.expected {
+			t.Fatalf("%v: expected %#v got %#v", tt.args, tt.expected, configured)
+		}
+	}
+
+	os.Args = []string{"cli", "redo", "-force"}
+	if err := CLI(TestingMigrator{}); err == nil {
+		t.Fatal("expected redo to reject the force flag")
+	}
+}
+
+func TestCLIStatusFormat(t *testing.T) {
+	defer func(w io.Writer) { Output = w }(Output)
+	var buf bytes.Buffer
+	Output = &buf
+	os.Args = []string{"cli", "status", "-format=json"}
+	check(CLI(TestingMigrator{}))
+	var report StatusReport
+	check(json.Unmarshal(buf.Bytes(), &report))
+	if report.Migrations == nil || report.Pending != 0 {
+		t.Fatalf("unexpected report %#v", report)
+	}
+
+	os.Args = []string{"cli", "status", "-format=xml"}
+	if err := CLI(TestingMigrator{}); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+func TestCLIHistoryFilter(t *testing.T) {
+	os.Args = []string{"cli", "history", "-silent", "-since=2021-01-08", "-until=2021-01-09T12:30:00"}
+	check(CLI(TestingMigrator{}))
+	since := time.Date(2021, 1, 8, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2021, 1, 9, 12, 30, 0, 0, time.UTC)
+	if !historyFilter.Since.Equal(since) || !historyFilter.Until.Equal(until) {
+		t.Fatalf("unexpected filter %#v", historyFilter)
+	}
+	os.Args = []string{"cli", "history", "-since=yesterday"}
+	if err := CLI(TestingMigrator{}); !errors.Is(err, ErrHistoryTime) {
+		t.Fatalf("expected ErrHistoryTime, got %v", err)
+	}
+}
@@ -0,0 +1,445 @@
+package imigrate
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"time"
+)
+
+// Dialect describes the SQL that differs between databases.
+//
+// Placeholder returns the bind parameter for the nth argument, starting at 1.
+//
+// QuoteIdent quotes a table or column name.
+//
+// CreateTableSQL returns the SQL to create the migrations table if it does not
+// exist.
+//
+// AddColumnSQL returns the SQL to add a column to an existing table. It is
+// used to upgrade migrations tables created by older versions.
+//
+// ColumnExistsSQL returns a query selecting the number of columns of a table
+// with a name, given as its first and second arguments. It selects 0 when
+// the table doesn't exist, rather than failing, since a failed statement
+// aborts the transaction on some databases.
+//
+// CreateHistoryTableSQL returns the SQL to create the append-only history
+// table if it does not exist.
+//
+// TemplateUp and TemplateDn return the SQL placed in generated migration
+// files.
+//
+// LockStrategy returns how concurrent migrators using the given migrations
+// table are kept apart. It may return nil if the database has no suitable
+// lock.
+//
+// Splitter returns how migrations are split into statements when
+// SplitStatements is set.
+type Dialect interface {
+	Placeholder(n int) string
+	QuoteIdent(name string) string
+	CreateTableSQL(table, versionColumn string) string
+	AddColumnSQL(table, column, columnType string) string
+	ColumnExistsSQL() string
+	CreateHistoryTableSQL(table string) string
+	TemplateUp() string
+	TemplateDn() string
+	LockStrategy(table string) LockStrategy
+	Splitter() Splitter
+}
+
+// LockStrategy takes and releases the migration lock. Both methods are called
+// with the same database session. TryLock must not block; it reports whether
+// the lock was acquired.
+type LockStrategy interface {
+	TryLock(ctx context.Context, db ExecutorContext) (bool, error)
+	Unlock(ctx context.Context, db ExecutorContext) error
+}
+
+// The built-in dialects.
+var (
+	SQLite     Dialect = sqliteDialect{}
+	PostgreSQL Dialect = postgresDialect{}
+	MySQL      Dialect = mysqlDialect{}
+	MSSQL      Dialect = mssqlDialect{}
+)
+
+func quote(name, open, close string) string {
+	return open + strings.Replace(name, close, close+close, -1) + close
+}
+
+// columnDefs returns the column definitions of a CREATE TABLE, one per line,
+// with each name quoted by d.
+func columnDefs(d Dialect, columns [][2]string) string {
+	defs := make([]string, len(columns))
+	for i, c := range columns {
+		defs[i] = "\t" + d.QuoteIdent(c[0]) + " " + c[1]
+	}
+	return strings.Join(defs, ",\n")
+}
+
+// lockKey derives a numeric advisory lock key from the migrations table name.
+func lockKey(table string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(table))
+	return int64(h.Sum64())
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (sqliteDialect) QuoteIdent(name string) string {
+	return quote(name, `"`, `"`)
+}
+
+func (o sqliteDialect) CreateTableSQL(table, versionColumn string) string {
+	return fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	%s integer primary key,
+	%s timestamp not null default (datetime(current_timestamp))
+);
+`, o.QuoteIdent(table), o.QuoteIdent(versionColumn), o.QuoteIdent("migrated_at"))
+}
+
+func (o sqliteDialect) AddColumnSQL(table, column, columnType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", o.QuoteIdent(table), o.QuoteIdent(column), columnType)
+}
+
+func (sqliteDialect) ColumnExistsSQL() string {
+	return "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+}
+
+func (o sqliteDialect) CreateHistoryTableSQL(table string) string {
+	return fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+%s
+);
+`, o.QuoteIdent(table), columnDefs(o, [][2]string{
+		{"id", "integer primary key"},
+		{"version", "integer not null"},
+		{"direction", "varchar(16) not null"},
+		{"name", "varchar(255)"},
+		{"file", "varchar(255)"},
+		{"checksum", "varchar(64)"},
+		{"recorded_at", "timestamp not null default (datetime(current_timestamp))"},
+		{"duration_ms", "bigint"},
+		{"outcome", "varchar(16) not null"},
+		{"error", "text"},
+		{"applied_by", "varchar(255)"},
+		{"build_id", "varchar(255)"},
+	}))
+}
+
+func (sqliteDialect) TemplateUp() string {
+	return `
+PRAGMA foreign_keys = ON;
+`
+}
+
+func (sqliteDialect) TemplateDn() string {
+	return `
+PRAGMA foreign_keys = OFF;
+`
+}
+
+func (o sqliteDialect) LockStrategy(table string) LockStrategy {
+	lockTable := o.QuoteIdent(table + "_lock")
+	now := "CAST(strftime('%s', 'now') AS integer)"
+	expires := fmt.Sprintf("%s + %d", now, int64(tableLockTTL/time.Second))
+	return tableLock{
+		createSQL:  fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id integer primary key, owner varchar(255) not null, expires_at integer not null, locked_at timestamp not null default (datetime(current_timestamp)))", lockTable),
+		breakSQL:   fmt.Sprintf("DELETE FROM %s WHERE id = 1 AND expires_at < %s", lockTable, now),
+		lockSQL:    fmt.Sprintf("INSERT OR IGNORE INTO %s (id, owner, expires_at) VALUES (1, ?, %s)", lockTable, expires),
+		refreshSQL: fmt.Sprintf("UPDATE %s SET expires_at = %s WHERE id = 1 AND owner = ?", lockTable, expires),
+		unlockSQL:  fmt.Sprintf("DELETE FROM %s WHERE id = 1 AND owner = ?", lockTable),
+		owner:      lockOwner(),
+	}
+}
+
+func (sqliteDialect) Splitter() Splitter {
+	return Splitter{}
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+func (postgresDialect) QuoteIdent(name string) string {
+	return quote(name, `"`, `"`)
+}
+
+func (o postgresDialect) CreateTableSQL(table, versionColumn string) string {
+	return fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	%s bigint primary key,
+	%s timestamp not null default current_timestamp
+);
+`, o.QuoteIdent(table), o.QuoteIdent(versionColumn), o.QuoteIdent("migrated_at"))
+}
+
+func (o postgresDialect) AddColumnSQL(table, column, columnType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", o.QuoteIdent(table), o.QuoteIdent(column), columnType)
+}
+
+func (postgresDialect) ColumnExistsSQL() string {
+	return "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2"
+}
+
+func (o postgresDialect) CreateHistoryTableSQL(table string) string {
+	return fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+%s
+);
+`, o.QuoteIdent(table), columnDefs(o, [][2]string{
+		{"id", "bigserial primary key"},
+		{"version", "bigint not null"},
+		{"direction", "varchar(16) not null"},
+		{"name", "varchar(255)"},
+		{"file", "varchar(255)"},
+		{"checksum", "varchar(64)"},
+		{"recorded_at", "timestamp not null default current_timestamp"},
+		{"duration_ms", "bigint"},
+		{"outcome", "varchar(16) not null"},
+		{"error", "text"},
+		{"applied_by", "varchar(255)"},
+		{"build_id", "varchar(255)"},
+	}))
+}
+
+func (postgresDialect) TemplateUp() string {
+	return ""
+}
+
+func (postgresDialect) TemplateDn() string {
+	return ""
+}
+
+func (postgresDialect) LockStrategy(table string) LockStrategy {
+	key := lockKey(table)
+	return advisoryLock{
+		lockSQL:   fmt.Sprintf("SELECT CASE WHEN pg_try_advisory_lock(%d) THEN 1 ELSE 0 END", key),
+		unlockSQL: fmt.Sprintf("SELECT pg_advisory_unlock(%d)", key),
+	}
+}
+
+func (postgresDialect) Splitter() Splitter {
+	return Splitter{DollarQuotes: true, EscapeStrings: true}
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (mysqlDialect) QuoteIdent(name string) string {
+	return quote(name, "`", "`")
+}
+
+func (o mysqlDialect) CreateTableSQL(table, versionColumn string) string {
+	return fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	%s bigint primary key,
+	%s timestamp not null default current_timestamp
+);
+`, o.QuoteIdent(table), o.QuoteIdent(versionColumn), o.QuoteIdent("migrated_at"))
+}
+
+func (o mysqlDialect) AddColumnSQL(table, column, columnType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", o.QuoteIdent(table), o.QuoteIdent(column), columnType)
+}
+
+func (mysqlDialect) ColumnExistsSQL() string {
+	return "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?"
+}
+
+func (o mysqlDialect) CreateHistoryTableSQL(table string) string {
+	return fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+%s
+);
+`, o.QuoteIdent(table), columnDefs(o, [][2]string{
+		{"id", "bigint auto_increment primary key"},
+		{"version", "bigint not null"},
+		{"direction", "varchar(16) not null"},
+		{"name", "varchar(255)"},
+		{"file", "varchar(255)"},
+		{"checksum", "varchar(64)"},
+		{"recorded_at", "timestamp not null default current_timestamp"},
+		{"duration_ms", "bigint"},
+		{"outcome", "varchar(16) not null"},
+		{"error", "text"},
+		{"applied_by", "varchar(255)"},
+		{"build_id", "varchar(255)"},
+	}))
+}
+
+func (mysqlDialect) TemplateUp() string {
+	return ""
+}
+
+func (mysqlDialect) TemplateDn() string {
+	return ""
+}
+
+func (mysqlDialect) LockStrategy(table string) LockStrategy {
+	name := strings.Replace(table, "'", "''", -1)
+	return advisoryLock{
+		lockSQL:   fmt.Sprintf("SELECT COALESCE(GET_LOCK('%s', 0), 0)", name),
+		unlockSQL: fmt.Sprintf("SELECT RELEASE_LOCK('%s')", name),
+	}
+}
+
+func (mysqlDialect) Splitter() Splitter {
+	return Splitter{BackslashEscapes: true, HashComments: true}
+}
+
+type mssqlDialect struct{}
+
+func (mssqlDialect) Placeholder(n int) string {
+	return fmt.Sprintf("@p%d", n)
+}
+
+func (mssqlDialect) QuoteIdent(name string) string {
+	return quote(name, "[", "]")
+}
+
+func (o mssqlDialect) CreateTableSQL(table, versionColumn string) string {
+	return fmt.Sprintf(`
+IF OBJECT_ID(N'%s', N'U') IS NULL
+CREATE TABLE %s (
+	%s bigint primary key,
+	%s datetime2 not null default current_timestamp
+);
+`, strings.Replace(table, "'", "''", -1), o.QuoteIdent(table), o.QuoteIdent(versionColumn), o.QuoteIdent("migrated_at"))
+}
+
+func (o mssqlDialect) AddColumnSQL(table, column, columnType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD %s %s", o.QuoteIdent(table), o.QuoteIdent(column), columnType)
+}
+
+func (mssqlDialect) ColumnExistsSQL() string {
+	return "SELECT COUNT(*) FROM sys.columns WHERE object_id = OBJECT_ID(QUOTENAME(@p1)) AND name = @p2"
+}
+
+func (o mssqlDialect) CreateHistoryTableSQL(table string) string {
+	return fmt.Sprintf(`
+IF OBJECT_ID(N'%s', N'U') IS NULL
+CREATE TABLE %s (
+%s
+);
+`, strings.Replace(table, "'", "''", -1), o.QuoteIdent(table), columnDefs(o, [][2]string{
+		{"id", "bigint identity primary key"},
+		{"version", "bigint not null"},
+		{"direction", "varchar(16) not null"},
+		{"name", "nvarchar(255)"},
+		{"file", "nvarchar(255)"},
+		{"checksum", "varchar(64)"},
+		{"recorded_at", "datetime2 not null default current_timestamp"},
+		{"duration_ms", "bigint"},
+		{"outcome", "varchar(16) not null"},
+		{"error", "nvarchar(max)"},
+		{"applied_by", "nvarchar(255)"},
+		{"build_id", "nvarchar(255)"},
+	}))
+}
+
+func (mssqlDialect) TemplateUp() string {
+	return ""
+}
+
+func (mssqlDialect) TemplateDn() string {
+	return ""
+}
+
+func (mssqlDialect) LockStrategy(table string) LockStrategy {
+	name := strings.Replace(table, "'", "''", -1)
+	return advisoryLock{
+		lockSQL: fmt.Sprintf(`DECLARE @result int;
+EXEC @result = sp_getapplock @Resource = N'%s', @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = 0;
+SELECT CASE WHEN @result >= 0 THEN 1 ELSE 0 END`, name),
+		unlockSQL: fmt.Sprintf("EXEC sp_releaseapplock @Resource = N'%s', @LockOwner = 'Session'", name),
+	}
+}
+
+func (mssqlDialect) Splitter() Splitter {
+	return Splitter{BatchSeparator: "GO"}
+}
+
+// advisoryLock is a session-level lock. lockSQL returns a single row holding
+// 1 when the lock was acquired.
+type advisoryLock struct {
+	lockSQL   string
+	unlockSQL string
+}
+
+func (o advisoryLock) TryLock(ctx context.Context, db ExecutorContext) (bool, error) {
+	rows, err := db.GetVersionsContext(ctx, o.lockSQL)
+	if err != nil {
+		return false, err
+	}
+	return len(rows) == 1 && rows[0] == 1, nil
+}
+
+func (o advisoryLock) Unlock(ctx context.Context, db ExecutorContext) error {
+	_, err := db.ExecContext(ctx, o.unlockSQL)
+	return err
+}
+
+// tableLockTTL is how long a tableLock row is valid unless it is refreshed.
+// An expired row is left by a crashed process and is deleted by the next
+// TryLock.
+const tableLockTTL = 5 * time.Minute
+
+// lockOwner identifies the process holding a tableLock.
+func lockOwner() string {
+	return fmt.Sprintf("%s pid %d at %d", defaultAppliedBy(), os.Getpid(), time.Now().UnixNano())
+}
+
+// tableLock holds the lock as a row in a lock table, for databases without
+// advisory locks. The row records its owner and when it expires, so the row
+// of a crashed process is broken once it expires. Each statement is atomic on
+// its own, so no transaction is needed, which could not be held across
+// statements by an Executor backed by a connection pool.
+type tableLock struct {
+	createSQL  string
+	breakSQL   string
+	lockSQL    string
+	refreshSQL string
+	unlockSQL  string
+	owner      string
+}
+
+func (o tableLock) TryLock(ctx context.Context, db ExecutorContext) (bool, error) {
+	if _, err := db.ExecContext(ctx, o.createSQL); err != nil {
+		return false, err
+	}
+	if _, err := db.ExecContext(ctx, o.breakSQL); err != nil {
+		return false, err
+	}
+	res, err := db.ExecContext(ctx, o.lockSQL, o.owner)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Refresh pushes back when the lock expires.
+func (o tableLock) Refresh(ctx context.Context, db ExecutorContext) error {
+	_, err := db.ExecContext(ctx, o.refreshSQL, o.owner)
+	return err
+}
+
+func (o tableLock) Unlock(ctx context.Context, db ExecutorContext) error {
+	_, err := db.ExecContext(ctx, o.unlockSQL, o.owner)
+	return err
+}
@@ -0,0 +1,136 @@
+package imigrate
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// dialectSQL renders every statement a dialect produces.
+func dialectSQL(d Dialect) string {
+	mig := NewIMigratorWithDialect(nil, nil, d)
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- create table\n%s\n", strings.TrimSpace(mig.CreateTableSQL))
+	fmt.Fprintf(&b, "-- select versions\n%s\n", mig.selectVersionsSQL())
+	fmt.Fprintf(&b, "-- insert version\n%s\n", mig.insertVersionSQL())
+	fmt.Fprintf(&b, "-- delete version\n%s\n", mig.deleteVersionSQL())
+	fmt.Fprintf(&b, "-- insert dirty version\n%s\n", mig.insertDirtySQL())
+	fmt.Fprintf(&b, "-- complete up\n%s\n", mig.completeUpSQL())
+	fmt.Fprintf(&b, "-- set dirty\n%s\n", mig.setDirtySQL())
+	fmt.Fprintf(&b, "-- column exists\n%s\n", d.ColumnExistsSQL())
+	fmt.Fprintf(&b, "-- create history table\n%s\n", strings.TrimSpace(d.CreateHistoryTableSQL(mig.HistoryTableName)))
+	fmt.Fprintf(&b, "-- insert history\n%s\n", mig.insertHistorySQL())
+	switch l := d.LockStrategy(mig.TableName).(type) {
+	case advisoryLock:
+		fmt.Fprintf(&b, "-- lock\n%s\n-- unlock\n%s\n", l.lockSQL, l.unlockSQL)
+	case tableLock:
+		fmt.Fprintf(&b, "-- create lock table\n%s\n-- break stale lock\n%s\n-- lock\n%s\n-- refresh lock\n%s\n-- unlock\n%s\n", l.createSQL, l.breakSQL, l.lockSQL, l.refreshSQL, l.unlockSQL)
+	}
+	fmt.Fprintf(&b, "-- template up\n%s\n", strings.TrimSpace(mig.TemplateUp))
+	fmt.Fprintf(&b, "-- template down\n%s\n", strings.TrimSpace(mig.TemplateDn))
+	fmt.Fprintf(&b, "-- splitter\n%+v\n", d.Splitter())
+	return b.String()
+}
+
+func TestDialectGolden(t *testing.T) {
+	dialects := map[string]Dialect{
+		"sqlite":     SQLite,
+		"postgresql": PostgreSQL,
+		"mysql":      MySQL,
+		"mssql":      MSSQL,
+	}
+	for name, d := range dialects {
+		t.Run(name, func(t *testing.T) {
+			got := dialectSQL(d)
+			golden := filepath.Join("testdata", "dialect", name+".sql")
+			if *update {
+				check(ioutil.WriteFile(golden, []byte(got), 0644))
+			}
+			want, err := ioutil.ReadFile(golden)
+			check(err)
+			if got != string(want) {
+				t.Fatalf("%s mismatch, run go test -update\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestDialectQuoteIdent(t *testing.T) {
+	tests := []struct {
+		d        Dialect
+		name     string
+		expected string
+	}{
+		{SQLite, `a"b`, `"a""b"`},
+		{PostgreSQL, `a"b`, `"a""b"`},
+		{MySQL, "a`b", "`a``b`"},
+		{MSSQL, "a]b", "[a]]b]"},
+	}
+	for _, tt := range tests {
+		if got := tt.d.QuoteIdent(tt.name); got != tt.expected {
+			t.Fatalf("expected %s got %s", tt.expected, got)
+		}
+	}
+}
+
+func TestDialectHistoryColumnsQuoted(t *testing.T) {
+	for _, d := range []Dialect{SQLite, PostgreSQL, MySQL, MSSQL} {
+		ddl := d.CreateHistoryTableSQL("history")
+		for _, c := range append([]string{"id", "recorded_at"}, historyColumns...) {
+			if !strings.Contains(ddl, "\t"+d.QuoteIdent(c)+" ") {
+				t.Fatalf("expected %s to be quoted in:\n%s", c, ddl)
+			}
+		}
+	}
+}
+
+func TestSQLiteTableLock(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	ctx := context.Background()
+	lock := SQLite.LockStrategy("shmig_version")
+
+	ok, err := lock.TryLock(ctx, WithContext(db))
+	check(err)
+	if !ok {
+		t.Fatal("expected the first TryLock to succeed")
+	}
+	ok, err = lock.TryLock(ctx, WithContext(db))
+	check(err)
+	if ok {
+		t.Fatal("expected the second TryLock to fail while locked")
+	}
+	check(lock.Unlock(ctx, WithContext(db)))
+	ok, err = lock.TryLock(ctx, WithContext(db))
+	check(err)
+	if !ok {
+		t.Fatal("expected TryLock to succeed after Unlock")
+	}
+
+	// A crashed process leaves its row behind until it expires.
+	other := SQLite.LockStrategy("shmig_version")
+	ok, err = other.TryLock(ctx, WithContext(db))
+	check(err)
+	if ok {
+		t.Fatal("expected another owner to fail while locked")
+	}
+	_, err = db.Exec(`UPDATE "shmig_version_lock" SET expires_at = 0`)
+	check(err)
+	ok, err = other.TryLock(ctx, WithContext(db))
+	check(err)
+	if !ok {
+		t.Fatal("expected an expired lock to be broken")
+	}
+	check(lock.Unlock(ctx, WithContext(db)))
+	ok, err = lock.TryLock(ctx, WithContext(db))
+	check(err)
+	if ok {
+		t.Fatal("expected Unlock not to release a lock it no longer owns")
+	}
+}
@@ -0,0 +1,102 @@
+package imigrate
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseDirectives sets the fields of m from the directives in its header. A
+// directive line holds one or more directives separated by commas or spaces:
+//
+//	-- imigrate: no-transaction, timeout=30s
+//	-- imigrate: irreversible
+//	-- imigrate: requires=1610069160
+func (o IMigrator) parseDirectives(m *Migration) error {
+	if o.DirectiveKey == nil {
+		return nil
+	}
+	for _, match := range o.DirectiveKey.FindAllStringSubmatch(m.Header, -1) {
+		fields := strings.FieldsFunc(match[len(match)-1], func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		})
+		for _, field := range fields {
+			if err := m.setDirective(field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (o *Migration) setDirective(directive string) error {
+	kv := strings.SplitN(directive, "=", 2)
+	name, value := kv[0], ""
+	if len(kv) == 2 {
+		value = kv[1]
+	}
+	switch {
+	case name == "no-transaction" && len(kv) == 1:
+		o.NoTransaction = true
+	case name == "irreversible" && len(kv) == 1:
+		o.Irreversible = true
+	case name == "timeout" && len(kv) == 2:
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q", value)
+		}
+		o.Timeout = d
+	case name == "requires" && len(kv) == 2:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid version %q", value)
+		}
+		o.Requires = append(o.Requires, v)
+	default:
+		return fmt.Errorf("unknown directive %q", directive)
+	}
+	return nil
+}
+
+func (o Migration) requires(version int64) bool {
+	for _, v := range o.Requires {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// withTimeout limits ctx to the migration's timeout, if it has one.
+func (o Migration) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, o.Timeout)
+}
+
+// checkRequires fails unless every version m requires is applied.
+func checkRequires(m Migration, applied map[int64]bool) error {
+	for _, v := range m.Requires {
+		if !applied[v] {
+			return newError(PhasePlan, &m, fmt.Errorf("%w: requires %d", ErrDependency, v))
+		}
+	}
+	return nil
+}
+
+// checkDown fails when m is irreversible, unless Force is set, or an applied
+// migration that isn't reverted first requires it.
+func (o IMigrator) checkDown(m Migration, applied, reverted map[int64]bool) error {
+	if m.Irreversible && !o.Force {
+		return newError(PhasePlan, &m, ErrIrreversible)
+	}
+	for _, other := range o.Migrations {
+		if applied[other.Version] && !reverted[other.Version] && other.requires(m.Version) {
+			return newError(PhasePlan, &m, fmt.Errorf("%w: required by %d", ErrDependency, other.Version))
+		}
+	}
+	return nil
+}
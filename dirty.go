@@ -0,0 +1,120 @@
+package imigrate
+
+import (
+	"context"
+	"fmt"
+)
+
+// completeUpSQL clears the dirty mark applyUp sets on migrations run without
+// a transaction, and records how long UP took.
+func (o IMigrator) completeUpSQL() string {
+	d := o.dialect()
+	return fmt.Sprintf("UPDATE %s SET %s = 0, %s = %s WHERE %s = %s", o.table(), d.QuoteIdent(o.DirtyColumn), d.QuoteIdent("duration_ms"), d.Placeholder(1), o.column(), d.Placeholder(2))
+}
+
+// setDirtySQL sets or clears the dirty mark of a version.
+func (o IMigrator) setDirtySQL() string {
+	d := o.dialect()
+	return fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s = %s", o.table(), d.QuoteIdent(o.DirtyColumn), d.Placeholder(1), o.column(), d.Placeholder(2))
+}
+
+func (o IMigrator) selectDirtySQL() string {
+	return fmt.Sprintf("SELECT %s FROM %s WHERE %s = 1 ORDER BY %s", o.column(), o.table(), o.dialect().QuoteIdent(o.DirtyColumn), o.column())
+}
+
+// transactional reports whether m runs in a transaction, so a failure leaves
+// nothing behind.
+func (o IMigrator) transactional(m Migration) bool {
+	_, ok := o.DB.(Transactor)
+	return ok && !m.NoTransaction
+}
+
+// leftDirty reports a failed migration that ran without a transaction. Its
+// version stays dirty, as the schema may hold part of the migration. A
+// transaction rolls back the version with the rest of the migration, so
+// there is nothing to report.
+func (o IMigrator) leftDirty(m Migration) {
+	if !o.transactional(m) {
+		o.log().Error("Migration left dirty", "version", m.Version, "file", m.fileName())
+	}
+}
+
+// getDirty returns the dirty versions.
+func (o *IMigrator) getDirty(ctx context.Context) ([]int64, error) {
+	versions, err := o.db().GetVersionsContext(ctx, o.selectDirtySQL())
+	if err != nil {
+		return nil, newError(PhaseStatus, nil, err)
+	}
+	return versions, nil
+}
+
+// checkDirty returns an error wrapping ErrDirty when a version is dirty. A
+// dry run doesn't upgrade the migrations table, so it skips the check when
+// the dirty column doesn't exist yet.
+func (o *IMigrator) checkDirty(ctx context.Context) error {
+	dirty, err := o.getDirty(ctx)
+	if err != nil {
+		if o.DryRun && !o.tableDone {
+			return nil
+		}
+		return err
+	}
+	if len(dirty) > 0 {
+		return &MigrationError{Phase: PhasePlan, Version: dirty[0], Err: fmt.Errorf("%w: %v, repair the schema then run force", ErrDirty, dirty)}
+	}
+	return nil
+}
+
+// ForceState records version as applied or pending without running its
+// migration, and clears its dirty mark. Use it once the schema of a migration
+// that failed part way through has been repaired by hand. state must be
+// StateApplied or StatePending. Recording a version as applied requires its
+// migration.
+func (o *IMigrator) ForceState(version int64, state MigrationState) error {
+	return o.ForceStateContext(context.Background(), version, state)
+}
+
+// ForceStateContext is like ForceState but stops with the context's error once
+// ctx is done.
+func (o *IMigrator) ForceStateContext(ctx context.Context, version int64, state MigrationState) error {
+	return o.runDirty(ctx, func(applied map[int64]bool) error {
+		m, ok := o.migration(version)
+		if !ok {
+			m = Migration{Version: version}
+		}
+		var query string
+		var args []interface{}
+		switch {
+		case state == StateApplied && applied[version]:
+			query, args = o.setDirtySQL(), []interface{}{0, version}
+		case state == StateApplied && ok:
+			query, args = o.insertVersionSQL(), o.recordArgs(m, false, 0)
+		case state == StateApplied:
+			return newError(PhasePlan, nil, fmt.Errorf("%w: %d", ErrUnknownVersion, version))
+		case state == StatePending && applied[version]:
+			query, args = o.deleteVersionSQL(), []interface{}{version}
+		case state == StatePending:
+			o.log().Info("Migration already pending", "version", version)
+			return nil
+		default:
+			return newError(PhasePlan, &m, fmt.Errorf("cannot force state %q, use %s or %s", state, StateApplied, StatePending))
+		}
+		if o.DryRun {
+			o.dryRunf("-- Dry run force %d %s", version, state)
+			o.dryRunf("%s; -- %v", query, args)
+			return nil
+		}
+		history := DirectionForceApplied
+		if state == StatePending {
+			history = DirectionForcePending
+		}
+		if _, err := o.db().ExecContext(ctx, query, args...); err != nil {
+			err = newError(PhaseRecord, &m, err)
+			o.appendHistory(m, history, 0, err)
+			return err
+		}
+		o.appendHistory(m, history, 0, nil)
+		o.log().Info("Migration forced", "version", version, "state", string(state))
+		return nil
+	})
+}
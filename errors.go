@@ -0,0 +1,99 @@
+package imigrate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Phase names the step of a migration run that failed.
+type Phase string
+
+const (
+	PhasePlan        Phase = "plan"        // Selecting the migrations to run.
+	PhaseSetup       Phase = "setup"       // Creating the migrations table or reading the migrations directory.
+	PhaseRead        Phase = "read"        // Opening or parsing a migration file.
+	PhaseUp          Phase = "up"          // Executing the UP SQL.
+	PhaseDown        Phase = "down"        // Executing the DOWN SQL.
+	PhaseRecord      Phase = "record"      // Updating the migrations table after UP or DOWN.
+	PhaseTransaction Phase = "transaction" // Beginning or committing the migration's transaction.
+	PhaseLock        Phase = "lock"        // Acquiring the migration lock.
+	PhaseVerify      Phase = "verify"      // Comparing checksums of applied migrations.
+	PhaseStatus      Phase = "status"      // Reading the completed versions.
+	PhaseCreate      Phase = "create"      // Generating a new migration file.
+	PhaseHook        Phase = "hook"        // A hook returned an error.
+)
+
+// ErrChecksumMismatch is wrapped by the error Up returns when StrictChecksums
+// is set and an applied migration file has changed.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrUnknownVersion is wrapped by the error returned when a command names a
+// version that has no migration.
+var ErrUnknownVersion = errors.New("unknown migration version")
+
+// ErrOutOfOrder is wrapped by the error returned when pending migrations are
+// older than the newest applied one and AllowOutOfOrder is not set.
+var ErrOutOfOrder = errors.New("migrations out of order")
+
+// ErrMissingFile is wrapped by the error returned when a command would revert
+// an applied version that has no migration file. Use Forget to remove it.
+var ErrMissingFile = errors.New("applied migration has no file")
+
+// ErrInvalidMigration is wrapped by the error returned when StrictValidation
+// is set and a migration file was rejected.
+var ErrInvalidMigration = errors.New("invalid migration file")
+
+// ErrDuplicateVersion is wrapped by the error returned when two migrations
+// have the same version.
+var ErrDuplicateVersion = errors.New("duplicate migration version")
+
+// ErrIrreversible is wrapped by the error returned when Down would revert a
+// migration marked irreversible and Force is not set.
+var ErrIrreversible = errors.New("migration is irreversible")
+
+// ErrDependency is wrapped by the error returned when a migration's requires
+// directive would be broken.
+var ErrDependency = errors.New("migration dependency not met")
+
+// ErrDirty is wrapped by the error returned when a migration failed part way
+// through and left its version dirty. Repair the schema by hand, then use
+// ForceState to record whether the migration is applied.
+var ErrDirty = errors.New("migration is dirty")
+
+// MigrationError is returned by the Migrator methods. It records the phase
+// that failed along with the migration version and file name when they are
+// known.
+type MigrationError struct {
+	Phase   Phase
+	Version int64
+	File    string
+	Err     error
+}
+
+func (o *MigrationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "imigrate: %s", o.Phase)
+	if o.Version != 0 {
+		fmt.Fprintf(&b, " version %d", o.Version)
+	}
+	if o.File != "" {
+		fmt.Fprintf(&b, " (%s)", o.File)
+	}
+	fmt.Fprintf(&b, ": %v", o.Err)
+	return b.String()
+}
+
+// Unwrap returns the underlying error.
+func (o *MigrationError) Unwrap() error {
+	return o.Err
+}
+
+func newError(phase Phase, m *Migration, err error) error {
+	e := &MigrationError{Phase: phase, Err: err}
+	if m != nil {
+		e.Version = m.Version
+		e.File = m.fileName()
+	}
+	return e
+}
@@ -1,6 +1,6 @@
 module github.com/sandro/imigrate
 
-go 1.15
+go 1.21
 
 require (
 	github.com/bvinc/go-sqlite-lite v0.6.1
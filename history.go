@@ -0,0 +1,262 @@
+package imigrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Direction is the kind of change a HistoryEntry records.
+type Direction string
+
+const (
+	DirectionUp       Direction = "up"       // UP was run.
+	DirectionDown     Direction = "down"     // DOWN was run, or skipped for a forced irreversible migration.
+	DirectionBaseline Direction = "baseline" // Recorded by Baseline without running UP.
+	DirectionForget   Direction = "forget"   // Removed by Forget without running DOWN.
+
+	DirectionForceApplied Direction = "force-applied" // Recorded as applied by ForceState.
+	DirectionForcePending Direction = "force-pending" // Recorded as pending by ForceState.
+)
+
+// Outcome tells whether the change a HistoryEntry records succeeded.
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+)
+
+// historyColumns are the columns insertHistorySQL writes.
+var historyColumns = []string{"version", "direction", "name", "file", "checksum", "duration_ms", "outcome", "error", "applied_by", "build_id"}
+
+// HistoryEntry is a row of the history table. At is formatted by the
+// database. Error holds the error of a failed change.
+type HistoryEntry struct {
+	Version    int64     `json:"version"`
+	Name       string    `json:"name,omitempty"`
+	File       string    `json:"file,omitempty"`
+	Direction  Direction `json:"direction"`
+	At         string    `json:"at,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	Outcome    Outcome   `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+	AppliedBy  string    `json:"applied_by,omitempty"`
+	BuildID    string    `json:"build_id,omitempty"`
+	Checksum   string    `json:"checksum,omitempty"`
+}
+
+// HistoryReport is returned by History. Entries are sorted oldest first.
+type HistoryReport struct {
+	Entries []HistoryEntry `json:"entries"`
+}
+
+// WriteText writes one line per entry.
+func (o *HistoryReport) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "HISTORY"); err != nil {
+		return err
+	}
+	for _, e := range o.Entries {
+		line := fmt.Sprintln(e.At, e.Direction, e.Version, e.Name, e.Outcome, fmt.Sprintf("%dms", e.DurationMS), e.AppliedBy, e.BuildID)
+		if e.Error != "" {
+			line = strings.TrimSuffix(line, "\n") + ": " + e.Error + "\n"
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the report as a JSON object.
+func (o *HistoryReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(o)
+}
+
+// WriteTable writes the report as an aligned table.
+func (o *HistoryReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "AT\tDIRECTION\tVERSION\tNAME\tOUTCOME\tDURATION\tAPPLIED BY\tBUILD\tERROR")
+	for _, e := range o.Entries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%dms\t%s\t%s\t%s\n", e.At, e.Direction, e.Version, e.Name, e.Outcome, e.DurationMS, e.AppliedBy, e.BuildID, e.Error)
+	}
+	return tw.Flush()
+}
+
+// HistoryFilter selects the entries History returns. Zero fields match every
+// entry. Since and Until are formatted without a time zone and compared with
+// the time the database recorded, so they must be in the database's time
+// zone, which is UTC for SQLite. Until is exclusive.
+type HistoryFilter struct {
+	Version int64
+	Since   time.Time
+	Until   time.Time
+}
+
+// historyTimeFormat is how HistoryFilter times are passed to the database.
+const historyTimeFormat = "2006-01-02 15:04:05"
+
+// History reports every change made to the migrations table, including
+// reverted and failed migrations, oldest first. It requires a DB that
+// implements RowGetter and a HistoryTableName.
+func (o *IMigrator) History(filter HistoryFilter) (*HistoryReport, error) {
+	return o.HistoryContext(context.Background(), filter)
+}
+
+// HistoryContext is like History but stops with the context's error once ctx
+// is done.
+func (o *IMigrator) HistoryContext(ctx context.Context, filter HistoryFilter) (*HistoryReport, error) {
+	if err := o.setupLocked(ctx); err != nil {
+		return nil, err
+	}
+	rg, ok := o.DB.(RowGetter)
+	if !ok {
+		return nil, newError(PhaseStatus, nil, errors.New("history requires a DB that implements RowGetter"))
+	}
+	if o.HistoryTableName == "" {
+		return nil, newError(PhaseStatus, nil, errors.New("history requires a HistoryTableName"))
+	}
+	d := o.dialect()
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, d.Placeholder(len(args))))
+	}
+	if filter.Version != 0 {
+		add(d.QuoteIdent("version")+" = %s", filter.Version)
+	}
+	if !filter.Since.IsZero() {
+		add(d.QuoteIdent("recorded_at")+" >= %s", filter.Since.Format(historyTimeFormat))
+	}
+	if !filter.Until.IsZero() {
+		add(d.QuoteIdent("recorded_at")+" < %s", filter.Until.Format(historyTimeFormat))
+	}
+	columns := []string{"version", "direction", "name", "file", "checksum", "recorded_at", "duration_ms", "outcome", "error", "applied_by", "build_id"}
+	for i, c := range columns {
+		columns[i] = d.QuoteIdent(c)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), o.historyTable())
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY " + d.QuoteIdent("id")
+	rows, err := rg.GetRows(ctx, query, args...)
+	if err != nil {
+		return nil, newError(PhaseStatus, nil, err)
+	}
+	report := &HistoryReport{Entries: []HistoryEntry{}}
+	for _, row := range rows {
+		v, err := strconv.ParseInt(row[0], 10, 64)
+		if err != nil {
+			return nil, newError(PhaseStatus, nil, err)
+		}
+		// A duration is missing for versions recorded by older versions.
+		duration, _ := strconv.ParseInt(row[6], 10, 64)
+		report.Entries = append(report.Entries, HistoryEntry{
+			Version:    v,
+			Direction:  Direction(row[1]),
+			Name:       row[2],
+			File:       row[3],
+			Checksum:   row[4],
+			At:         row[5],
+			DurationMS: duration,
+			Outcome:    Outcome(row[7]),
+			Error:      row[8],
+			AppliedBy:  row[9],
+			BuildID:    row[10],
+		})
+	}
+	return report, nil
+}
+
+func (o IMigrator) historyTable() string {
+	return o.dialect().QuoteIdent(o.HistoryTableName)
+}
+
+// insertHistorySQL inserts the arguments built by appendHistory.
+func (o IMigrator) insertHistorySQL() string {
+	d := o.dialect()
+	columns := make([]string, len(historyColumns))
+	placeholders := make([]string, len(historyColumns))
+	for i, c := range historyColumns {
+		columns[i] = d.QuoteIdent(c)
+		placeholders[i] = d.Placeholder(i + 1)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", o.historyTable(), strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+}
+
+// createHistoryTable creates the history table when HistoryTableName is set.
+// A new table is seeded with the versions already in the migrations table, so
+// History covers migrations applied before the table existed.
+func (o IMigrator) createHistoryTable(ctx context.Context) error {
+	if o.HistoryTableName == "" {
+		return nil
+	}
+	d := o.dialect()
+	exists, err := o.hasColumn(ctx, o.HistoryTableName, "version")
+	if err != nil {
+		return newError(PhaseSetup, nil, fmt.Errorf("checking history table: %w", err))
+	}
+	if exists {
+		return nil
+	}
+	if _, err := o.db().ExecContext(ctx, d.CreateHistoryTableSQL(o.HistoryTableName)); err != nil {
+		return newError(PhaseSetup, nil, fmt.Errorf("creating history table: %w", err))
+	}
+	// Every version was recorded as an UP, or as a baseline, that succeeded.
+	direction := fmt.Sprintf("CASE WHEN %s = 1 THEN '%s' ELSE '%s' END", d.QuoteIdent(o.BaselineColumn), DirectionBaseline, DirectionUp)
+	from := map[string]string{
+		"version":     o.column(),
+		"direction":   direction,
+		"checksum":    d.QuoteIdent(o.ChecksumColumn),
+		"recorded_at": d.QuoteIdent("migrated_at"),
+		"outcome":     fmt.Sprintf("'%s'", OutcomeSuccess),
+	}
+	var columns, values []string
+	for _, c := range []string{"version", "direction", "name", "file", "checksum", "recorded_at", "duration_ms", "outcome", "applied_by", "build_id"} {
+		columns = append(columns, d.QuoteIdent(c))
+		if v, ok := from[c]; ok {
+			values = append(values, v)
+		} else {
+			values = append(values, d.QuoteIdent(c))
+		}
+	}
+	seed := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ORDER BY %s, %s",
+		o.historyTable(), strings.Join(columns, ", "), strings.Join(values, ", "), o.table(), d.QuoteIdent("migrated_at"), o.column())
+	if _, err := o.db().ExecContext(ctx, seed); err != nil {
+		return newError(PhaseSetup, nil, fmt.Errorf("seeding history table: %w", err))
+	}
+	return nil
+}
+
+// appendHistory adds an entry for m to the history table. It runs outside the
+// migration's transaction and ignores its context, so a failed or canceled
+// migration is still recorded. A failure to record is logged rather than
+// returned, as the change itself is already done or rolled back.
+func (o IMigrator) appendHistory(m Migration, direction Direction, d time.Duration, err error) {
+	if o.HistoryTableName == "" {
+		return
+	}
+	outcome, text := OutcomeSuccess, ""
+	if err != nil {
+		outcome, text = OutcomeFailure, err.Error()
+	}
+	checksum := m.Checksum()
+	if m.Up == "" && m.Dn == "" && m.UpFunc == nil && m.DnFunc == nil {
+		// A version without a migration has nothing to sum.
+		checksum = ""
+	}
+	args := []interface{}{m.Version, string(direction), m.Name, m.fileName(), checksum, d.Milliseconds(), string(outcome), text, o.AppliedBy, o.BuildID}
+	if _, err := o.db().ExecContext(context.Background(), o.insertHistorySQL(), args...); err != nil {
+		o.log().Error("History not recorded", "version", m.Version, "error", err)
+	}
+}
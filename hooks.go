@@ -0,0 +1,83 @@
+package imigrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Event describes a run, or one migration in it, to a hook.
+type Event struct {
+	Command   string        // up, down, redo, rollback or goto.
+	Direction Direction     // DirectionUp or DirectionDown. Empty for BeforeAll and AfterAll.
+	Migration *Migration    // Nil for BeforeAll and AfterAll.
+	Start     time.Time     // When the run or the migration started.
+	Duration  time.Duration // Zero in BeforeAll and BeforeEach.
+	Err       error         // Why the run or the migration failed, in OnError and AfterAll.
+	DryRun    bool          // Set when nothing is run. See IMigrator.DryRun.
+}
+
+// HookFunc is called by IMigrator at a point of a run. A non-nil error aborts
+// the run and is returned wrapped in a *MigrationError with PhaseHook.
+type HookFunc func(ctx context.Context, e Event) error
+
+// Hooks are called by Up, Down, Redo, Rollback and Goto while they hold the
+// migration lock. Nil hooks are skipped.
+type Hooks struct {
+	BeforeAll  HookFunc                           // Called before the first migration of a run.
+	BeforeEach HookFunc                           // Called before each migration.
+	AfterEach  HookFunc                           // Called after each migration that succeeded.
+	AfterAll   HookFunc                           // Called when the run ends, with Err set if it failed. Its error is returned only when the run succeeded.
+	OnError    func(ctx context.Context, e Event) // Called when a migration fails, with Err set.
+}
+
+// hook calls h, wrapping its error. name says which hook failed.
+func (o IMigrator) hook(ctx context.Context, name string, h HookFunc, e Event) error {
+	if h == nil {
+		return nil
+	}
+	if err := h(ctx, e); err != nil {
+		return newError(PhaseHook, e.Migration, fmt.Errorf("%s hook: %w", name, err))
+	}
+	return nil
+}
+
+// runHooked is like run but calls the BeforeAll and AfterAll hooks around f,
+// and tells the other hooks which command is running.
+func (o *IMigrator) runHooked(ctx context.Context, command string, f func(applied map[int64]bool) error) error {
+	return o.run(ctx, func(applied map[int64]bool) error {
+		o.command = command
+		defer func() { o.command = "" }()
+		e := Event{Command: command, Start: time.Now(), DryRun: o.DryRun}
+		err := o.hook(ctx, "before all", o.Hooks.BeforeAll, e)
+		if err == nil {
+			err = f(applied)
+		}
+		e.Duration, e.Err = time.Since(e.Start), err
+		if afterErr := o.hook(ctx, "after all", o.Hooks.AfterAll, e); err == nil {
+			err = afterErr
+		}
+		return err
+	})
+}
+
+// each runs f, which applies or reverts m, between the BeforeEach and
+// AfterEach hooks, and calls OnError when it fails.
+func (o IMigrator) each(ctx context.Context, direction Direction, m Migration, f func() error) error {
+	e := Event{Command: o.command, Direction: direction, Migration: &m, Start: time.Now(), DryRun: o.DryRun}
+	o.log().Debug("Running", migrationAttrs(m, direction)...)
+	o.keepLock(ctx)
+	if err := o.hook(ctx, "before each", o.Hooks.BeforeEach, e); err != nil {
+		return err
+	}
+	err := f()
+	e.Duration = time.Since(e.Start)
+	if err != nil {
+		e.Err = err
+		if o.Hooks.OnError != nil {
+			o.Hooks.OnError(ctx, e)
+		}
+		return err
+	}
+	return o.hook(ctx, "after each", o.Hooks.AfterEach, e)
+}
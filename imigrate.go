@@ -2,10 +2,15 @@ package imigrate
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
@@ -17,7 +22,10 @@ import (
 	"time"
 )
 
+// Logger receives the messages of DefaultLog and the text reports of CLI.
 var Logger = log.Default()
+
+// DiscardLogger is a Logger that writes nothing.
 var DiscardLogger = log.New(io.Discard, "", log.LstdFlags)
 
 // Executor is the interface to executing SQL
@@ -33,6 +41,66 @@ type Executor interface {
 	GetVersions(query string, args ...interface{}) ([]int64, error)
 }
 
+// ExecutorContext is the context-aware variant of Executor. When the DB given
+// to IMigrator implements it, ExecContext and GetVersionsContext are used so a
+// cancelled context or an expired deadline can abort a running statement.
+type ExecutorContext interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	GetVersionsContext(ctx context.Context, query string, args ...interface{}) ([]int64, error)
+}
+
+// WithContext adapts an Executor to ExecutorContext. If db already implements
+// ExecutorContext it is returned unchanged. Otherwise the context is checked
+// before every call, so a run stops between statements once the context is
+// done.
+func WithContext(db Executor) ExecutorContext {
+	if ctxDB, ok := db.(ExecutorContext); ok {
+		return ctxDB
+	}
+	return contextExecutor{db}
+}
+
+// RowGetter is implemented by Executors that can return arbitrary rows. Each
+// column is returned as a string, with NULL as "". IMigrator needs it to read
+// anything other than versions from the migrations table, such as checksums.
+type RowGetter interface {
+	GetRows(ctx context.Context, query string, args ...interface{}) ([][]string, error)
+}
+
+// Tx is a transaction started by a Transactor.
+type Tx interface {
+	Executor
+	Commit() error
+	Rollback() error
+}
+
+// Transactor is implemented by Executors that support transactions. When the
+// DB given to IMigrator implements it, each migration and its migrations table
+// update are committed together, unless the migration file opts out with a
+// no-transaction directive before the UP marker or its SQL holds its own
+// BEGIN or COMMIT.
+type Transactor interface {
+	Begin(ctx context.Context) (Tx, error)
+}
+
+type contextExecutor struct {
+	Executor
+}
+
+func (o contextExecutor) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return o.Exec(query, args...)
+}
+
+func (o contextExecutor) GetVersionsContext(ctx context.Context, query string, args ...interface{}) ([]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return o.GetVersions(query, args...)
+}
+
 // Migrator is the interface for running migrations.
 //
 // Create is used to create a new migration file. The file should be prefixed
@@ -47,40 +115,151 @@ type Executor interface {
 //
 // Rollback runs the DOWN migration for the most recenlty created migration.
 //
-// Status prints out which migrations have been run thus far.
+// Status reports which migrations have been run and which are pending.
+//
+// Every method returns a *MigrationError when it fails. The other commands
+// of CLI are available when the migrator also implements GotoMigrator,
+// HistoryMigrator, RepairMigrator, ForgetMigrator, ValidateMigrator,
+// BaselineMigrator or ForceMigrator.
 type Migrator interface {
-	Create(string)
-	Up(int, int64)
-	Down(int, int64)
-	Redo(int, int64)
-	Rollback(int)
-	Status()
+	Create(string) error
+	Up(int, int64) error
+	Down(int, int64) error
+	Redo(int, int64) error
+	Rollback(int) error
+	Status() (*StatusReport, error)
 }
 
-// Migration represents a single migration file
+// ContextMigrator is implemented by migrators whose runs can be cancelled.
+// CLIContext uses it when available.
+type ContextMigrator interface {
+	UpContext(context.Context, int, int64) error
+	DownContext(context.Context, int, int64) error
+	RedoContext(context.Context, int, int64) error
+	RollbackContext(context.Context, int) error
+	StatusContext(context.Context) (*StatusReport, error)
+}
+
+// asContextMigrator returns migrator as a ContextMigrator, ignoring the
+// context for migrators that don't support one.
+func asContextMigrator(migrator Migrator) ContextMigrator {
+	if cm, ok := migrator.(ContextMigrator); ok {
+		return cm
+	}
+	return contextMigrator{migrator}
+}
+
+type contextMigrator struct {
+	Migrator
+}
+
+func (o contextMigrator) UpContext(_ context.Context, steps int, version int64) error {
+	return o.Up(steps, version)
+}
+func (o contextMigrator) DownContext(_ context.Context, steps int, version int64) error {
+	return o.Down(steps, version)
+}
+func (o contextMigrator) RedoContext(_ context.Context, steps int, version int64) error {
+	return o.Redo(steps, version)
+}
+func (o contextMigrator) RollbackContext(_ context.Context, steps int) error {
+	return o.Rollback(steps)
+}
+func (o contextMigrator) StatusContext(_ context.Context) (*StatusReport, error) {
+	return o.Status()
+}
+
+// GotoMigrator is implemented by migrators that can migrate up or down to a
+// version. CLI uses it for goto.
+type GotoMigrator interface {
+	Goto(int64) error
+	GotoContext(context.Context, int64) error
+}
+
+// HistoryMigrator is implemented by migrators that report the changes made
+// to the migrations table. CLI uses it for history.
+type HistoryMigrator interface {
+	History(HistoryFilter) (*HistoryReport, error)
+	HistoryContext(context.Context, HistoryFilter) (*HistoryReport, error)
+}
+
+// RepairMigrator is implemented by migrators that can record the current
+// checksum of every applied migration. CLI uses it for repair.
+type RepairMigrator interface {
+	Repair() error
+	RepairContext(context.Context) error
+}
+
+// ForgetMigrator is implemented by migrators that can remove an applied
+// version whose migration file is missing. CLI uses it for forget.
+type ForgetMigrator interface {
+	Forget(int64) error
+	ForgetContext(context.Context, int64) error
+}
+
+// ValidateMigrator is implemented by migrators that can list the migration
+// files they can't use. CLI uses it for validate.
+type ValidateMigrator interface {
+	Validate() ([]Rejection, error)
+}
+
+// BaselineMigrator is implemented by migrators that can record migrations up
+// to a version as applied without running them. CLI uses it for baseline.
+type BaselineMigrator interface {
+	Baseline(int64) error
+	BaselineContext(context.Context, int64) error
+}
+
+// ForceMigrator is implemented by migrators that can record a version as
+// applied or pending and clear its dirty mark. CLI uses it for force.
+type ForceMigrator interface {
+	ForceState(int64, MigrationState) error
+	ForceStateContext(context.Context, int64, MigrationState) error
+}
+
+// MigrationFunc is the body of a Go migration. db is the migration's
+// transaction when the DB is a Transactor.
+type MigrationFunc func(db Executor) error
+
+// Migration represents a single migration file, or a Go migration registered
+// with IMigrator.Register.
 type Migration struct {
-	Version  int64
-	Time     time.Time
-	FileInfo os.FileInfo
-	Up       string
-	Dn       string
+	Version       int64
+	Time          time.Time
+	Name          string      // The file name without version prefix and extension, or the registered name.
+	FileInfo      os.FileInfo // Nil for Go migrations.
+	Header        string      // The lines before the UP marker.
+	Up            string
+	Dn            string
+	UpFunc        MigrationFunc // Run instead of Up for Go migrations.
+	DnFunc        MigrationFunc // Run instead of Dn for Go migrations.
+	NoTransaction bool          // Run without a transaction even if the DB is a Transactor.
+	Irreversible  bool          // Refuse to run DOWN.
+	Timeout       time.Duration // How long UP or DOWN may run. Zero means no limit.
+	Requires      []int64       // Versions that must be applied before this one.
 }
 
 // Valid reads and stores the UP and DOWN SQL queries, and returns true if both
 // are found.
-func (o *Migration) Valid(file http.File, upKey, dnKey *regexp.Regexp) (valid bool) {
-	upStart := false
-	dnStart := false
+func (o *Migration) Valid(file http.File, upKey, dnKey *regexp.Regexp) bool {
+	upStart, dnStart, err := o.parse(file, upKey, dnKey)
+	if err != nil {
+		DefaultLog.Error("read string error", "error", err)
+	}
+	return upStart && dnStart
+}
+
+// parse reads and stores the header, UP and DOWN SQL, and reports which
+// markers were found.
+func (o *Migration) parse(file io.Reader, upKey, dnKey *regexp.Regexp) (upStart, dnStart bool, err error) {
 	reader := bufio.NewReader(file)
 	for {
 		l, err := reader.ReadString('\n')
 		if err != nil {
 			if err == io.EOF {
-				valid = upStart && dnStart
 				break
 			}
-			Logger.Println("read string error", err)
-			break
+			return false, false, err
 		}
 		if !upStart && upKey.MatchString(l) {
 			upStart = true
@@ -90,6 +269,9 @@ func (o *Migration) Valid(file http.File, upKey, dnKey *regexp.Regexp) (valid bo
 			dnStart = true
 			continue
 		}
+		if !upStart {
+			o.Header += l
+		}
 		if upStart && !dnStart {
 			o.Up += l
 		}
@@ -97,28 +279,92 @@ func (o *Migration) Valid(file http.File, upKey, dnKey *regexp.Regexp) (valid bo
 			o.Dn += l
 		}
 	}
-	return valid
+	return upStart, dnStart, nil
+}
+
+func (o Migration) fileName() string {
+	if o.FileInfo == nil {
+		return ""
+	}
+	return o.FileInfo.Name()
+}
+
+// migrationName strips the version prefix and extension from a file name.
+func migrationName(fileName, version string) string {
+	name := strings.TrimPrefix(fileName, version)
+	name = strings.TrimSuffix(name, path.Ext(name))
+	return strings.TrimLeft(name, "-_")
 }
 
 // IMigrator is the default migrator that satisfies the Migrator interface.
 type IMigrator struct {
 	DB                Executor
 	FS                http.FileSystem
+	Files             fs.FS          // The migrations as an io/fs.FS, such as an embed.FS. Used instead of FS when set.
 	Dirname           string         // The directory where migrations are stored.
 	UpKey             *regexp.Regexp // The Regexp to detecth the up migration SQL.
 	DnKey             *regexp.Regexp // The Regexp to detecth the down migration SQL.
 	TableName         string         // The table where migration info is stored.
 	VersionColumn     string         // The version column in the migrations table.
+	ChecksumColumn    string         // The checksum column in the migrations table.
+	BaselineColumn    string         // The column marking versions recorded by Baseline.
+	DirtyColumn       string         // The column marking versions whose UP or DOWN did not finish.
+	AppliedBy         string         // Recorded with each migration. Defaults to user@hostname.
+	BuildID           string         // Recorded with each migration, such as the application's version or commit.
 	CreateTableSQL    string         // The SQL to create the migrations table.
+	HistoryTableName  string         // The append-only table logging every change to the migrations table. Empty disables it.
 	Migrations        []Migration
+	Rejected          []Rejection    // The migration files setup skipped, and why.
 	FileVersionRegexp *regexp.Regexp // The Regexp to detect a migration file.
 	TemplateUp        string         // The SQL to place in the UP section of a generated file.
 	TemplateDn        string         // The SQL to place in the DOWN section of a generated file.
+	NoTxKey           *regexp.Regexp // The Regexp to detect a header line that disables the transaction.
+	TxStatementKey    *regexp.Regexp // The Regexp to detect a BEGIN or COMMIT in the SQL, which also disables the transaction.
+	DirectiveKey      *regexp.Regexp // The Regexp to detect a header line of directives. The last group holds the directives.
+	Dialect           Dialect        // The SQL dialect of DB.
+	NoLock            bool           // Skip the migration lock.
+	LockTimeout       time.Duration  // How long to wait for the migration lock. Defaults to DefaultLockTimeout. Zero waits until the context is done.
+	StrictChecksums   bool           // Refuse to run Up when an applied migration's checksum has changed.
+	AllowOutOfOrder   bool           // Apply pending migrations older than the newest applied one instead of refusing.
+	StrictValidation  bool           // Refuse to run when a migration file is rejected.
+	DryRun            bool           // Print the SQL Up and Down would run instead of running it.
+	DryRunOutput      io.Writer      // Where DryRun prints. Defaults to the writer of the package Logger.
+	SplitStatements   bool           // Run the statements of a SQL migration one Exec at a time, split by the dialect's Splitter.
+	Force             bool           // Revert irreversible migrations by deleting their version without running DOWN.
+	Hooks             Hooks          // Called around runs and migrations.
+	Log               LevelLogger    // Where the migrator logs. Defaults to DefaultLog.
+	LogLevel          slog.Level     // The lowest level logged. Defaults to slog.LevelInfo. LevelSilent logs nothing.
+	goMigrations      []Migration
+	tableDone         bool
 	setupDone         bool
+	command           string // The command being run, for hook events.
+	refreshLock       func(ctx context.Context) error
 }
 
 // NewIMigrator returns a default migrator with the SQLite dialect.
 func NewIMigrator(db Executor, fs http.FileSystem) *IMigrator {
+	return NewIMigratorWithDialect(db, fs, SQLite)
+}
+
+// NewIMigratorFS returns a default migrator with the SQLite dialect that reads
+// migrations from fsys, such as an embed.FS:
+//
+//	//go:embed migrations/*.sql
+//	var migrations embed.FS
+//
+//	migrator := imigrate.NewIMigratorFS(db, migrations)
+//
+// If fsys is already rooted at the migrations directory, for example by
+// fs.Sub, set Dirname to ".".
+func NewIMigratorFS(db Executor, fsys fs.FS) *IMigrator {
+	m := NewIMigrator(db, nil)
+	m.Files = fsys
+	return m
+}
+
+// NewIMigratorWithDialect returns a default migrator whose migrations table
+// and templates come from dialect.
+func NewIMigratorWithDialect(db Executor, fs http.FileSystem, dialect Dialect) *IMigrator {
 	m := &IMigrator{
 		DB:                db,
 		FS:                fs,
@@ -127,241 +373,948 @@ func NewIMigrator(db Executor, fs http.FileSystem) *IMigrator {
 		DnKey:             regexp.MustCompile(`^\s*--.*DOWN`),
 		TableName:         "shmig_version",
 		VersionColumn:     "version",
+		ChecksumColumn:    "checksum",
+		BaselineColumn:    "baseline",
+		DirtyColumn:       "dirty",
+		HistoryTableName:  "shmig_version_history",
+		AppliedBy:         defaultAppliedBy(),
+		LockTimeout:       DefaultLockTimeout,
 		FileVersionRegexp: regexp.MustCompile(`^\d+`),
-		TemplateUp: `
-PRAGMA foreign_keys = ON;
-
-BEGIN;
-COMMIT;
-`,
-		TemplateDn: `
-PRAGMA foreign_keys = OFF;
-
-BEGIN;
-COMMIT;`,
-	}
-	m.CreateTableSQL = fmt.Sprintf(`
-CREATE TABLE IF NOT EXISTS %s (
-	%s integer primary key,
-	migrated_at timestamp not null default (datetime(current_timestamp))
-);
-`, m.TableName, m.VersionColumn)
+		NoTxKey:           regexp.MustCompile(`(?m)^\s*--\s*imigrate:\s*no-transaction\b`),
+		TxStatementKey:    regexp.MustCompile(`(?im)^\s*(BEGIN(\s+(DEFERRED|IMMEDIATE|EXCLUSIVE))?(\s+(TRANSACTION|TRAN|WORK))?|START\s+TRANSACTION|COMMIT(\s+(TRANSACTION|TRAN|WORK))?)\s*;`),
+		DirectiveKey:      regexp.MustCompile(`(?m)^\s*--\s*imigrate:(.*)$`),
+		TemplateUp:        dialect.TemplateUp(),
+		TemplateDn:        dialect.TemplateDn(),
+		Dialect:           dialect,
+	}
+	m.CreateTableSQL = dialect.CreateTableSQL(m.TableName, m.VersionColumn)
 	return m
 }
 
-func (o IMigrator) createTable() {
-	_, err := o.DB.Exec(o.CreateTableSQL)
+// Configure applies the CLI options. Options only ever switch behavior on, so
+// settings made in code are kept.
+func (o *IMigrator) Configure(opts Options) {
+	o.NoLock = o.NoLock || opts.NoLock
+	o.DryRun = o.DryRun || opts.DryRun
+	o.AllowOutOfOrder = o.AllowOutOfOrder || opts.AllowOutOfOrder
+	o.Force = o.Force || opts.Force
+	if opts.Verbose && o.LogLevel > slog.LevelDebug {
+		o.LogLevel = slog.LevelDebug
+	}
+	if opts.Silent {
+		o.LogLevel = LevelSilent
+	}
+}
+
+func (o IMigrator) dialect() Dialect {
+	if o.Dialect == nil {
+		return SQLite
+	}
+	return o.Dialect
+}
+
+// table and column return the quoted migrations table and version column.
+func (o IMigrator) table() string {
+	return o.dialect().QuoteIdent(o.TableName)
+}
+
+func (o IMigrator) column() string {
+	return o.dialect().QuoteIdent(o.VersionColumn)
+}
+
+func (o IMigrator) selectVersionsSQL() string {
+	return fmt.Sprintf("SELECT %s FROM %s ORDER BY %s", o.column(), o.table(), o.column())
+}
+
+// insertVersionSQL inserts the arguments returned by recordArgs.
+func (o IMigrator) insertVersionSQL() string {
+	return o.insertRecordSQL(0)
+}
+
+// insertDirtySQL is like insertVersionSQL but marks the version dirty.
+func (o IMigrator) insertDirtySQL() string {
+	return o.insertRecordSQL(1)
+}
+
+func (o IMigrator) insertRecordSQL(dirty int) string {
+	d := o.dialect()
+	columns := []string{o.column(), d.QuoteIdent(o.ChecksumColumn), d.QuoteIdent(o.BaselineColumn)}
+	for _, c := range auditColumns {
+		columns = append(columns, d.QuoteIdent(c.name))
+	}
+	placeholders := make([]string, len(columns))
+	for i := range placeholders {
+		placeholders[i] = d.Placeholder(i + 1)
+	}
+	columns = append(columns, d.QuoteIdent(o.DirtyColumn))
+	placeholders = append(placeholders, strconv.Itoa(dirty))
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", o.table(), strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+}
+
+func (o IMigrator) deleteVersionSQL() string {
+	return fmt.Sprintf("DELETE FROM %s WHERE %s = %s", o.table(), o.column(), o.dialect().Placeholder(1))
+}
+
+func (o IMigrator) db() ExecutorContext {
+	return WithContext(o.DB)
+}
+
+func (o IMigrator) createTable(ctx context.Context) error {
+	_, err := o.db().ExecContext(ctx, o.CreateTableSQL)
 	if err != nil {
-		Logger.Panicln(err)
+		return newError(PhaseSetup, nil, err)
+	}
+	if err := o.addColumn(ctx, o.ChecksumColumn, "varchar(64)"); err != nil {
+		return err
+	}
+	if err := o.addColumn(ctx, o.BaselineColumn, "smallint"); err != nil {
+		return err
 	}
+	for _, c := range auditColumns {
+		if err := o.addColumn(ctx, c.name, c.columnType); err != nil {
+			return err
+		}
+	}
+	if err := o.addColumn(ctx, o.DirtyColumn, "smallint"); err != nil {
+		return err
+	}
+	return o.createHistoryTable(ctx)
 }
 
-func (o *IMigrator) getCompletedVersions() []int64 {
-	versions, err := o.DB.GetVersions(fmt.Sprintf("select %s from %s order by %s", o.VersionColumn, o.TableName, o.VersionColumn))
+// addColumn adds column to the migrations table unless it already exists, so
+// tables created by older versions are upgraded in place.
+func (o IMigrator) addColumn(ctx context.Context, column, columnType string) error {
+	ok, err := o.hasColumn(ctx, o.TableName, column)
 	if err != nil {
-		Logger.Panicln(err)
+		return newError(PhaseSetup, nil, fmt.Errorf("checking column %s: %w", column, err))
 	}
-	return versions
+	if ok {
+		return nil
+	}
+	if _, err := o.db().ExecContext(ctx, o.dialect().AddColumnSQL(o.TableName, column, columnType)); err != nil {
+		return newError(PhaseSetup, nil, fmt.Errorf("adding column %s: %w", column, err))
+	}
+	return nil
 }
 
-func (o *IMigrator) setup() {
-	if o.setupDone {
-		return
+// hasColumn reports whether table has column. It is false when the table
+// doesn't exist.
+func (o IMigrator) hasColumn(ctx context.Context, table, column string) (bool, error) {
+	counts, err := o.db().GetVersionsContext(ctx, o.dialect().ColumnExistsSQL(), table, column)
+	if err != nil {
+		return false, err
 	}
-	o.createTable()
-	root, err := o.FS.Open(o.Dirname)
+	return len(counts) == 1 && counts[0] > 0, nil
+}
+
+func (o *IMigrator) getCompletedVersions(ctx context.Context) ([]int64, error) {
+	versions, err := o.db().GetVersionsContext(ctx, o.selectVersionsSQL())
 	if err != nil {
-		Logger.Panicln("couldn't open", o.Dirname, err)
+		return nil, newError(PhaseStatus, nil, err)
 	}
-	defer root.Close()
-	finfos, err := root.Readdir(-1)
+	return versions, nil
+}
+
+// getApplied returns the completed versions as a set. In a dry run a missing
+// migrations table means nothing has been applied.
+func (o *IMigrator) getApplied(ctx context.Context) (map[int64]bool, error) {
+	if o.DryRun && !o.tableDone {
+		exists, err := o.hasColumn(ctx, o.TableName, o.VersionColumn)
+		if err != nil {
+			return nil, newError(PhaseStatus, nil, err)
+		}
+		if !exists {
+			return map[int64]bool{}, nil
+		}
+	}
+	versions, err := o.getCompletedVersions(ctx)
 	if err != nil {
-		Logger.Panicln("err during readdir", o.Dirname, err)
+		return nil, err
 	}
-	for _, info := range finfos {
-		n := o.FileVersionRegexp.FindString(info.Name())
-		nn, err := strconv.ParseInt(n, 10, 64)
+	applied := make(map[int64]bool, len(versions))
+	for _, v := range versions {
+		applied[v] = true
+	}
+	return applied, nil
+}
+
+// setupLocked is like setup but holds the migration lock while the
+// migrations table is created or upgraded. Once it is, no lock is taken, so
+// Status and History don't wait for a running migration.
+func (o *IMigrator) setupLocked(ctx context.Context) error {
+	if !o.tableDone {
+		unlock, err := o.lock(ctx)
 		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	return o.setup(ctx)
+}
+
+func (o *IMigrator) setup(ctx context.Context) error {
+	if !o.tableDone && !o.DryRun {
+		if err := o.createTable(ctx); err != nil {
+			return err
+		}
+		o.tableDone = true
+	}
+	if !o.setupDone {
+		if err := o.load(); err != nil {
+			return err
+		}
+		o.setupDone = true
+	}
+	for _, r := range o.Rejected {
+		if r.Reason == RejectDuplicate {
+			return &MigrationError{Phase: PhaseSetup, Version: r.Version, File: r.File, Err: fmt.Errorf("%w: %v", ErrDuplicateVersion, r.Err)}
+		}
+	}
+	return nil
+}
+
+// load reads the migration files into Migrations. Files that can't be used
+// are recorded in Rejected instead.
+func (o *IMigrator) load() error {
+	o.Migrations = nil
+	o.Rejected = nil
+	finfos, err := o.readDir()
+	if err != nil {
+		return newError(PhaseSetup, nil, err)
+	}
+	sort.Slice(finfos, func(i, j int) bool { return finfos[i].Name() < finfos[j].Name() })
+	seen := make(map[int64]string, len(finfos)+len(o.goMigrations))
+	for _, m := range o.goMigrations {
+		if other, ok := seen[m.Version]; ok {
+			o.reject("", m.Version, RejectDuplicate, fmt.Errorf("Go migrations %s and %s", other, m.Name))
 			continue
 		}
-		f, err := o.FS.Open(path.Join(o.Dirname, info.Name()))
+		seen[m.Version] = m.Name
+		o.Migrations = append(o.Migrations, m)
+	}
+	for _, info := range finfos {
+		if info.IsDir() {
+			continue
+		}
+		n := o.FileVersionRegexp.FindString(info.Name())
+		nn, err := strconv.ParseInt(n, 10, 64)
 		if err != nil {
-			Logger.Println("couldn't open file", o.Dirname, info.Name(), err)
+			o.reject(info.Name(), 0, RejectNoVersion, nil)
 			continue
 		}
 		migration := Migration{
 			Version:  nn,
 			Time:     time.Unix(nn, 0),
+			Name:     migrationName(info.Name(), n),
 			FileInfo: info,
 		}
-		if migration.Valid(f, o.UpKey, o.DnKey) {
-			o.Migrations = append(o.Migrations, migration)
+		content, err := o.readFile(info.Name())
+		if err != nil {
+			o.reject(info.Name(), nn, RejectUnreadable, err)
+			continue
+		}
+		hasUp, hasDn, err := migration.parse(bytes.NewReader(content), o.UpKey, o.DnKey)
+		switch {
+		case err != nil:
+			o.reject(info.Name(), nn, RejectUnreadable, err)
+			continue
+		case !hasUp:
+			o.reject(info.Name(), nn, RejectMissingUp, nil)
+			continue
+		case !hasDn:
+			o.reject(info.Name(), nn, RejectMissingDown, nil)
+			continue
 		}
-		f.Close()
-		o.setupDone = true
+		if other, ok := seen[nn]; ok {
+			o.reject(info.Name(), nn, RejectDuplicate, fmt.Errorf("%s and %s", other, info.Name()))
+			continue
+		}
+		if err := o.parseDirectives(&migration); err != nil {
+			o.reject(info.Name(), nn, RejectDirective, err)
+			continue
+		}
+		if o.NoTxKey != nil && o.NoTxKey.MatchString(migration.Header) {
+			migration.NoTransaction = true
+		}
+		// Files generated by older versions manage their own transaction,
+		// which can't be nested in the one inTx would start.
+		if o.TxStatementKey != nil && (o.TxStatementKey.MatchString(migration.Up) || o.TxStatementKey.MatchString(migration.Dn)) {
+			migration.NoTransaction = true
+		}
+		seen[nn] = info.Name()
+		o.Migrations = append(o.Migrations, migration)
 	}
+	return nil
 }
 
-func (o IMigrator) migrated(m Migration) bool {
-	for _, v := range o.getCompletedVersions() {
-		if v == m.Version {
-			return true
+// readDir lists the migrations directory in Files, or in FS when Files is
+// nil. It returns nothing when neither is set.
+func (o *IMigrator) readDir() ([]os.FileInfo, error) {
+	if o.Files != nil {
+		entries, err := fs.ReadDir(o.Files, o.Dirname)
+		if err != nil {
+			return nil, fmt.Errorf("readdir %s: %w", o.Dirname, err)
+		}
+		finfos := make([]os.FileInfo, 0, len(entries))
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				return nil, fmt.Errorf("stat %s: %w", e.Name(), err)
+			}
+			finfos = append(finfos, info)
 		}
+		return finfos, nil
 	}
-	return false
+	if o.FS == nil {
+		return nil, nil
+	}
+	root, err := o.FS.Open(o.Dirname)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open %s: %w", o.Dirname, err)
+	}
+	defer root.Close()
+	finfos, err := root.Readdir(-1)
+	if err != nil {
+		return nil, fmt.Errorf("readdir %s: %w", o.Dirname, err)
+	}
+	return finfos, nil
 }
 
-func getLastId(res sql.Result) int64 {
-	id, err := res.LastInsertId()
+// readFile reads a file from the migrations directory.
+func (o *IMigrator) readFile(name string) ([]byte, error) {
+	if o.Files != nil {
+		return fs.ReadFile(o.Files, path.Join(o.Dirname, name))
+	}
+	f, err := o.FS.Open(path.Join(o.Dirname, name))
 	if err != nil {
-		Logger.Panicln(err)
+		return nil, err
 	}
-	return id
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Register adds a Go migration. Go migrations are ordered with the migration
+// files by version and recorded in the same migrations table. A nil down
+// function makes Down a no-op, as an empty DOWN section does. A version that
+// is already registered, or used by a file, is rejected as a duplicate.
+func (o *IMigrator) Register(version int64, name string, up, down MigrationFunc) {
+	o.goMigrations = append(o.goMigrations, Migration{
+		Version: version,
+		Time:    time.Unix(version, 0),
+		Name:    name,
+		UpFunc:  up,
+		DnFunc:  down,
+	})
+	o.setupDone = false
+}
+
+// rowsAffected returns the rows affected by res for logging. Drivers that
+// don't support it report 0.
+func rowsAffected(res sql.Result) int64 {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return n
 }
 
 // Up runs all migrations that have not been run.  If steps is greater than -1,
 // it will run that many migrations in ascending order.  If version is greater
 // than 0, it will migrate up that specific version.
-func (o *IMigrator) Up(steps int, version int64) {
-	o.setup()
+//
+// Up refuses to run when a pending migration is older than the newest applied
+// one, unless AllowOutOfOrder is set. Naming the version applies it anyway.
+func (o *IMigrator) Up(steps int, version int64) error {
+	return o.UpContext(context.Background(), steps, version)
+}
+
+// UpContext is like Up but stops with the context's error once ctx is done.
+func (o *IMigrator) UpContext(ctx context.Context, steps int, version int64) error {
+	return o.runHooked(ctx, "up", func(applied map[int64]bool) error {
+		return o.up(ctx, steps, version, applied)
+	})
+}
+
+// run sets up the migrator and calls f while holding the migration lock.
+// f receives the applied versions, which execUp and execDown keep current.
+// It refuses to call f while a version is dirty.
+func (o *IMigrator) run(ctx context.Context, f func(applied map[int64]bool) error) error {
+	return o.runDirty(ctx, func(applied map[int64]bool) error {
+		if err := o.checkDirty(ctx); err != nil {
+			return err
+		}
+		return f(applied)
+	})
+}
+
+// runDirty is like run but calls f even while a version is dirty.
+// The lock is taken first, as creating or upgrading the migrations table
+// isn't safe to run twice at once.
+func (o *IMigrator) runDirty(ctx context.Context, f func(applied map[int64]bool) error) error {
+	unlock, err := o.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := o.setup(ctx); err != nil {
+		return err
+	}
+	if err := o.checkRejected(); err != nil {
+		return err
+	}
+	applied, err := o.getApplied(ctx)
+	if err != nil {
+		return err
+	}
+	return f(applied)
+}
+
+func (o *IMigrator) up(ctx context.Context, steps int, version int64, applied map[int64]bool) error {
+	plan, err := o.planUp(steps, version, applied)
+	if err != nil {
+		return err
+	}
+	if err := o.checkUp(ctx, plan, applied); err != nil {
+		return err
+	}
+	return o.upAll(ctx, plan, applied)
+}
+
+// planUp returns the pending migrations Up would apply, oldest first. It
+// fails when pending migrations are out of order, unless AllowOutOfOrder is
+// set or version names the one to apply.
+func (o *IMigrator) planUp(steps int, version int64, applied map[int64]bool) ([]Migration, error) {
 	if version != 0 {
-		o.upVersion(version)
-		return
+		if m, ok := o.migration(version); ok && !applied[version] {
+			return []Migration{m}, nil
+		}
+		return nil, nil
+	}
+	if late := o.outOfOrder(applied); len(late) > 0 {
+		if !o.AllowOutOfOrder {
+			return nil, newError(PhasePlan, nil, fmt.Errorf("%w: %v", ErrOutOfOrder, late))
+		}
+		o.log().Warn("Applying out of order", "versions", late)
 	}
 	o.sortAscending()
-	completed := 0
+	var plan []Migration
 	for _, m := range o.Migrations {
-		if completed == steps {
+		if len(plan) == steps {
 			break
 		}
-		if !o.migrated(m) {
-			o.execUp(m)
-			completed++
+		if !applied[m.Version] {
+			plan = append(plan, m)
 		}
 	}
+	return plan, nil
 }
 
-func (o IMigrator) execUp(m Migration) {
-	res, err := o.DB.Exec(strings.TrimSpace(m.Up))
-	if err != nil {
-		Logger.Panicln("Migration err", m.Version, err)
+// checkUp fails when plan can't be applied in order on top of applied: a
+// migration requires a version that is neither applied nor applied earlier
+// in plan, or an applied migration's checksum changed and StrictChecksums is
+// set.
+func (o IMigrator) checkUp(ctx context.Context, plan []Migration, applied map[int64]bool) error {
+	// A dry run doesn't upgrade the migrations table, so checksums are only
+	// verified once the table is known to be current.
+	if len(applied) > 0 && o.tableDone {
+		if err := o.checkChecksums(ctx); err != nil {
+			return err
+		}
 	}
-	Logger.Printf("Up completed %d %d\n", m.Version, getLastId(res))
-	res, err = o.DB.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES(?)", o.TableName, o.VersionColumn), m.Version)
+	will := make(map[int64]bool, len(applied)+len(plan))
+	for v, ok := range applied {
+		will[v] = ok
+	}
+	for _, m := range plan {
+		if err := checkRequires(m, will); err != nil {
+			return err
+		}
+		will[m.Version] = true
+	}
+	return nil
+}
+
+// upAll applies plan in order. The plan must have passed checkUp.
+func (o IMigrator) upAll(ctx context.Context, plan []Migration, applied map[int64]bool) error {
+	for _, m := range plan {
+		if err := o.execUp(ctx, m, applied); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printDryRun prints what execUp or execDown would run.
+func (o IMigrator) printDryRun(direction string, m Migration, query, recordSQL string, args ...interface{}) {
+	name := m.fileName()
+	if name == "" {
+		name = m.Name
+	}
+	o.dryRunf("-- Dry run %s %d (%s)", direction, m.Version, name)
+	if m.UpFunc != nil || m.DnFunc != nil {
+		o.dryRunf("-- Go migration")
+	} else {
+		for _, stmt := range o.statements(query) {
+			o.dryRunf("%s", stmt)
+			if o.SplitStatements {
+				o.dryRunf("%s", StatementBreak)
+			}
+		}
+	}
+	o.dryRunf("%s; -- %v", recordSQL, args)
+}
+
+// dryRunf writes a line of dry run output to DryRunOutput, like the text
+// status report, so it isn't formatted as a log record. LevelSilent drops
+// it.
+func (o IMigrator) dryRunf(format string, args ...interface{}) {
+	if o.LogLevel >= LevelSilent {
+		return
+	}
+	w := o.DryRunOutput
+	if w == nil {
+		w = Logger.Writer()
+	}
+	fmt.Fprintf(w, format+"\n", args...)
+}
+
+// execBody runs a Go migration function, or the SQL when there is none.
+func (o IMigrator) execBody(ctx context.Context, db Executor, query string, f MigrationFunc) (sql.Result, error) {
+	if f != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return driver.RowsAffected(0), f(db)
+	}
+	var res sql.Result = driver.RowsAffected(0)
+	stmts := o.statements(query)
+	for i, stmt := range stmts {
+		o.log().Debug("Executing", "statement", i+1, "sql", stmt)
+		var err error
+		if res, err = WithContext(db).ExecContext(ctx, stmt); err != nil {
+			if len(stmts) > 1 {
+				return nil, fmt.Errorf("statement %d: %w", i+1, err)
+			}
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// statements returns the SQL to run for query, split into statements when
+// SplitStatements is set.
+func (o IMigrator) statements(query string) []string {
+	if o.SplitStatements {
+		return o.dialect().Splitter().Split(query)
+	}
+	if query = strings.TrimSpace(query); query != "" {
+		return []string{query}
+	}
+	return nil
+}
+
+// inTx calls f with a transaction when the DB is a Transactor and the
+// migration allows it, and with the DB itself otherwise.
+func (o IMigrator) inTx(ctx context.Context, m Migration, f func(db Executor) error) error {
+	if !o.transactional(m) {
+		return f(o.DB)
+	}
+	tx, err := o.DB.(Transactor).Begin(ctx)
 	if err != nil {
-		Logger.Panicln("could not complete UP migration", err)
+		return newError(PhaseTransaction, &m, err)
+	}
+	if err := f(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			o.log().Error("Rollback failed", "version", m.Version, "error", rbErr)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return newError(PhaseTransaction, &m, err)
 	}
-	Logger.Println("Migration table updated", getLastId(res))
+	return nil
 }
 
-func (o IMigrator) upVersion(version int64) {
-	for _, m := range o.Migrations {
-		if m.Version == version && !o.migrated(m) {
-			o.execUp(m)
-			break
+func (o IMigrator) execUp(ctx context.Context, m Migration, applied map[int64]bool) error {
+	return o.each(ctx, DirectionUp, m, func() error {
+		return o.applyUp(ctx, m, applied)
+	})
+}
+
+func (o IMigrator) applyUp(ctx context.Context, m Migration, applied map[int64]bool) error {
+	if o.DryRun {
+		o.printDryRun("up", m, m.Up, o.insertVersionSQL(), o.recordArgs(m, false, 0)...)
+		applied[m.Version] = true
+		return nil
+	}
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	// Without a transaction, the version is recorded as dirty first, so a
+	// migration that fails part way through can't be mistaken for pending.
+	if !o.transactional(m) {
+		if _, err := o.db().ExecContext(ctx, o.insertDirtySQL(), o.recordArgs(m, false, 0)...); err != nil {
+			err = newError(PhaseRecord, &m, err)
+			o.appendHistory(m, DirectionUp, time.Since(start), err)
+			return err
 		}
 	}
+	err := o.inTx(ctx, m, func(db Executor) error {
+		return o.execUpIn(ctx, db, m)
+	})
+	o.appendHistory(m, DirectionUp, time.Since(start), err)
+	if err != nil {
+		o.leftDirty(m)
+		return err
+	}
+	applied[m.Version] = true
+	return nil
+}
+
+func (o IMigrator) execUpIn(ctx context.Context, db Executor, m Migration) error {
+	start := time.Now()
+	res, err := o.execBody(ctx, db, m.Up, m.UpFunc)
+	if err != nil {
+		return newError(PhaseUp, &m, err)
+	}
+	o.log().Info("Up completed", append(migrationAttrs(m, DirectionUp), "duration", time.Since(start), "rows_affected", rowsAffected(res))...)
+	query, args := o.completeUpSQL(), []interface{}{time.Since(start).Milliseconds(), m.Version}
+	if o.transactional(m) {
+		query, args = o.insertVersionSQL(), o.recordArgs(m, false, time.Since(start))
+	}
+	if _, err := WithContext(db).ExecContext(ctx, query, args...); err != nil {
+		return newError(PhaseRecord, &m, err)
+	}
+	o.log().Debug("Migration table updated", "version", m.Version)
+	return nil
 }
 
 // Down runs all migrations in descending order.
 // If steps is greater than -1, it will step down that many migrations.
 // If version is greater than 0, it will only migrate down that specific
 // version.
-func (o *IMigrator) Down(steps int, version int64) {
-	o.setup()
+//
+// Down refuses to run, returning an error wrapping ErrMissingFile, when it
+// would revert an applied version whose migration file is missing.
+func (o *IMigrator) Down(steps int, version int64) error {
+	return o.DownContext(context.Background(), steps, version)
+}
+
+// DownContext is like Down but stops with the context's error once ctx is
+// done.
+func (o *IMigrator) DownContext(ctx context.Context, steps int, version int64) error {
+	return o.runHooked(ctx, "down", func(applied map[int64]bool) error {
+		return o.down(ctx, steps, version, applied)
+	})
+}
+
+func (o *IMigrator) down(ctx context.Context, steps int, version int64, applied map[int64]bool) error {
+	return o.downAll(ctx, downVersions(steps, version, applied), applied)
+}
+
+// downVersions returns the applied versions Down reverts, newest first.
+func downVersions(steps int, version int64, applied map[int64]bool) []int64 {
 	if version != 0 {
-		o.downVersion(version)
-		return
+		if applied[version] {
+			return []int64{version}
+		}
+		return nil
 	}
-	o.sortDescending()
-	completed := 0
-	for _, m := range o.Migrations {
-		if completed == steps {
+	var versions []int64
+	for _, v := range appliedDescending(applied) {
+		if len(versions) == steps {
 			break
 		}
-		if o.migrated(m) {
-			o.execDown(m)
-			completed++
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// downAll reverts versions in order. It fails before running anything when
+// planDown does.
+func (o IMigrator) downAll(ctx context.Context, versions []int64, applied map[int64]bool) error {
+	plan, err := o.planDown(versions, applied)
+	if err != nil {
+		return err
+	}
+	return o.revertAll(ctx, plan, applied)
+}
+
+// planDown returns the migrations of versions, which are reverted in order.
+// It fails when one of them has no migration file, is irreversible, or is
+// required by a migration that stays applied.
+func (o IMigrator) planDown(versions []int64, applied map[int64]bool) ([]Migration, error) {
+	plan := make([]Migration, len(versions))
+	reverted := make(map[int64]bool, len(versions))
+	for i, v := range versions {
+		m, ok := o.migration(v)
+		if !ok {
+			return nil, orphanError(v)
+		}
+		if err := o.checkDown(m, applied, reverted); err != nil {
+			return nil, err
+		}
+		plan[i] = m
+		reverted[v] = true
+	}
+	return plan, nil
+}
+
+// revertAll reverts plan in order. The plan must come from planDown.
+func (o IMigrator) revertAll(ctx context.Context, plan []Migration, applied map[int64]bool) error {
+	for _, m := range plan {
+		if err := o.execDown(ctx, m, applied); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func (o IMigrator) execDown(ctx context.Context, m Migration, applied map[int64]bool) error {
+	return o.each(ctx, DirectionDown, m, func() error {
+		return o.applyDown(ctx, m, applied)
+	})
 }
 
-func (o IMigrator) execDown(m Migration) {
-	res, err := o.DB.Exec(m.Dn)
+func (o IMigrator) applyDown(ctx context.Context, m Migration, applied map[int64]bool) error {
+	recorded := m
+	if m.Irreversible {
+		// Only reached with Force, which removes the version without
+		// running DOWN.
+		m.Dn, m.DnFunc = "", nil
+		o.log().Warn("Forcing irreversible, DOWN is not run", migrationAttrs(m, DirectionDown)...)
+	}
+	if o.DryRun {
+		o.printDryRun("down", m, m.Dn, o.deleteVersionSQL(), m.Version)
+		delete(applied, m.Version)
+		return nil
+	}
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	if !o.transactional(m) {
+		if _, err := o.db().ExecContext(ctx, o.setDirtySQL(), 1, m.Version); err != nil {
+			err = newError(PhaseRecord, &m, err)
+			o.appendHistory(recorded, DirectionDown, time.Since(start), err)
+			return err
+		}
+	}
+	err := o.inTx(ctx, m, func(db Executor) error {
+		return o.execDownIn(ctx, db, m)
+	})
+	o.appendHistory(recorded, DirectionDown, time.Since(start), err)
 	if err != nil {
-		Logger.Panicln("Migration err", m.Version, err)
+		o.leftDirty(m)
+		return err
 	}
-	Logger.Printf("Down completed %d %d\n", m.Version, getLastId(res))
-	res, err = o.DB.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", o.TableName, o.VersionColumn), m.Version)
+	delete(applied, m.Version)
+	return nil
+}
+
+func (o IMigrator) execDownIn(ctx context.Context, db Executor, m Migration) error {
+	start := time.Now()
+	res, err := o.execBody(ctx, db, m.Dn, m.DnFunc)
 	if err != nil {
-		Logger.Panicln("could not complete DOWN migration", err)
+		return newError(PhaseDown, &m, err)
+	}
+	o.log().Info("Down completed", append(migrationAttrs(m, DirectionDown), "duration", time.Since(start), "rows_affected", rowsAffected(res))...)
+	if _, err := WithContext(db).ExecContext(ctx, o.deleteVersionSQL(), m.Version); err != nil {
+		return newError(PhaseRecord, &m, err)
 	}
-	Logger.Println("Migration table updated", getLastId(res))
+	o.log().Debug("Migration table updated", "version", m.Version)
+	return nil
 }
 
-func (o IMigrator) downVersion(version int64) {
-	for _, m := range o.Migrations {
-		if m.Version == version && o.migrated(m) {
-			o.execDown(m)
-			break
+// Redo runs Down, then applies the reverted migrations again, oldest first.
+// It fails before running anything when one of them can't be reverted or
+// applied. Irreversible migrations are refused even with Force.
+func (o *IMigrator) Redo(steps int, version int64) error {
+	return o.RedoContext(context.Background(), steps, version)
+}
+
+// RedoContext is like Redo but stops with the context's error once ctx is
+// done.
+func (o *IMigrator) RedoContext(ctx context.Context, steps int, version int64) error {
+	return o.runHooked(ctx, "redo", func(applied map[int64]bool) error {
+		versions := downVersions(steps, version, applied)
+		down, err := o.planDown(versions, applied)
+		if err != nil {
+			return err
 		}
-	}
+		remaining := make(map[int64]bool, len(applied))
+		for v, ok := range applied {
+			remaining[v] = ok
+		}
+		up := make([]Migration, len(down))
+		for i, m := range down {
+			delete(remaining, m.Version)
+			up[len(down)-1-i] = m
+		}
+		if err := checkReapply(down, up); err != nil {
+			return err
+		}
+		if err := o.checkUp(ctx, up, remaining); err != nil {
+			return err
+		}
+		if err := o.revertAll(ctx, down, applied); err != nil {
+			return err
+		}
+		return o.upAll(ctx, up, applied)
+	})
 }
 
-// Redo runs Down, then Up
-func (o *IMigrator) Redo(steps int, version int64) {
-	o.Down(steps, version)
-	o.Up(steps, version)
+// checkReapply fails when an irreversible migration in down is applied again
+// by up. Force reverts it without running DOWN, so its UP would run against a
+// schema that still has its changes.
+func checkReapply(down, up []Migration) error {
+	for _, m := range down {
+		if !m.Irreversible {
+			continue
+		}
+		for _, u := range up {
+			if u.Version == m.Version {
+				return newError(PhasePlan, &m, ErrIrreversible)
+			}
+		}
+	}
+	return nil
 }
 
 // Rollback runs the down SQL for the most recent migration.
 // If steps is greater than 1, it will run that many migrations down.
-func (o *IMigrator) Rollback(steps int) {
-	o.Down(steps, 0)
+func (o *IMigrator) Rollback(steps int) error {
+	return o.RollbackContext(context.Background(), steps)
 }
 
-// Status prints out which migrations have been run and which are pending.
-func (o *IMigrator) Status() {
-	Logger.Println("STATUS")
-	o.setup()
-	for _, v := range o.getCompletedVersions() {
-		Logger.Println("Migration Completed", v)
-	}
-	o.pending()
+// RollbackContext is like Rollback but stops with the context's error once
+// ctx is done.
+func (o *IMigrator) RollbackContext(ctx context.Context, steps int) error {
+	return o.runHooked(ctx, "rollback", func(applied map[int64]bool) error {
+		return o.down(ctx, steps, 0, applied)
+	})
 }
 
-func (o *IMigrator) sortAscending() {
-	sort.Slice(o.Migrations, func(i, j int) bool { return o.Migrations[i].Version < o.Migrations[j].Version })
+// Goto migrates to target. Applied migrations newer than target are reverted
+// newest first, then pending migrations up to and including target are
+// applied oldest first. A target of 0 reverts every migration; any other
+// target must be the version of a migration. Goto fails before running
+// anything when a migration can't be reverted or applied.
+func (o *IMigrator) Goto(target int64) error {
+	return o.GotoContext(context.Background(), target)
 }
-func (o *IMigrator) sortDescending() {
-	sort.Slice(o.Migrations, func(i, j int) bool { return o.Migrations[i].Version > o.Migrations[j].Version })
+
+// GotoContext is like Goto but stops with the context's error once ctx is
+// done.
+func (o *IMigrator) GotoContext(ctx context.Context, target int64) error {
+	return o.runHooked(ctx, "goto", func(applied map[int64]bool) error {
+		if target != 0 && !o.hasVersion(target) {
+			return newError(PhasePlan, nil, fmt.Errorf("%w: %d", ErrUnknownVersion, target))
+		}
+		var newer []int64
+		remaining := make(map[int64]bool, len(applied))
+		for _, v := range appliedDescending(applied) {
+			if v > target {
+				newer = append(newer, v)
+			} else {
+				remaining[v] = true
+			}
+		}
+		down, err := o.planDown(newer, applied)
+		if err != nil {
+			return err
+		}
+		var pending int
+		for _, m := range o.Migrations {
+			if m.Version <= target && !remaining[m.Version] {
+				pending++
+			}
+		}
+		var up []Migration
+		if pending > 0 {
+			if up, err = o.planUp(pending, 0, remaining); err != nil {
+				return err
+			}
+			if err := checkReapply(down, up); err != nil {
+				return err
+			}
+			if err := o.checkUp(ctx, up, remaining); err != nil {
+				return err
+			}
+		}
+		if err := o.revertAll(ctx, down, applied); err != nil {
+			return err
+		}
+		return o.upAll(ctx, up, applied)
+	})
+}
+
+func (o IMigrator) hasVersion(version int64) bool {
+	_, ok := o.migration(version)
+	return ok
+}
+
+// migration returns the migration with the given version.
+func (o IMigrator) migration(version int64) (Migration, bool) {
+	for _, m := range o.Migrations {
+		if m.Version == version {
+			return m, true
+		}
+	}
+	return Migration{}, false
 }
 
-func (o IMigrator) pending() {
+// outOfOrder returns the pending versions that are older than the newest
+// applied version, such as migrations from a branch merged late.
+func (o *IMigrator) outOfOrder(applied map[int64]bool) []int64 {
+	var newest int64
+	for v, ok := range applied {
+		if ok && v > newest {
+			newest = v
+		}
+	}
+	var late []int64
 	o.sortAscending()
 	for _, m := range o.Migrations {
-		if !o.migrated(m) {
-			Logger.Println("Pending", m.Version)
+		if !applied[m.Version] && m.Version < newest {
+			late = append(late, m.Version)
 		}
 	}
+	return late
+}
+
+func (o *IMigrator) sortAscending() {
+	sort.Slice(o.Migrations, func(i, j int) bool { return o.Migrations[i].Version < o.Migrations[j].Version })
 }
 
 // Create generates a new migration file in the Dirname directory.  The file is
 // prefixed with the current time as a unix timestamp, followed by the provided
-// name.  It will insert the provided TemplateUp and TemplateDn strings into
-// the appropriate sections of the migration file.
-func (o IMigrator) Create(name string) {
-	err := os.MkdirAll(o.Dirname, os.ModeDir)
+// name.  If a file in Dirname already has that timestamp or a later one, the
+// newest version plus one is used instead.  It will insert the provided
+// TemplateUp and TemplateDn strings into the appropriate sections of the
+// migration file.
+func (o IMigrator) Create(name string) error {
+	err := os.MkdirAll(o.Dirname, 0755)
 	if err != nil {
-		Logger.Panicln(err)
+		return newError(PhaseCreate, nil, err)
 	}
 	now := time.Now()
-	fname := fmt.Sprintf("%d-%s.sql", now.Unix(), name)
-	path := filepath.Join(o.Dirname, fname)
-	Logger.Println("Created", path)
-	f, err := os.Create(path)
+	version, err := o.nextVersion(now.Unix())
 	if err != nil {
-		Logger.Panicln(err)
+		return newError(PhaseCreate, nil, err)
+	}
+	var fname, path string
+	var f *os.File
+	for {
+		fname = fmt.Sprintf("%d-%s.sql", version, name)
+		path = filepath.Join(o.Dirname, fname)
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			break
+		}
+		version++
+	}
+	if err != nil {
+		return &MigrationError{Phase: PhaseCreate, Version: version, File: fname, Err: err}
 	}
 	defer f.Close()
 	template := fmt.Sprintf(`
@@ -379,5 +1332,25 @@ func (o IMigrator) Create(name string) {
 		strings.TrimSpace(o.TemplateUp),
 		strings.TrimSpace(o.TemplateDn),
 	)
-	f.WriteString(strings.TrimSpace(template))
+	if _, err := f.WriteString(strings.TrimSpace(template)); err != nil {
+		return &MigrationError{Phase: PhaseCreate, Version: version, File: fname, Err: err}
+	}
+	o.log().Info("Created", "file", path)
+	return nil
+}
+
+// nextVersion returns version, or one past the newest file in Dirname when
+// that is not older, so files created within the same second don't collide.
+func (o IMigrator) nextVersion(version int64) (int64, error) {
+	entries, err := os.ReadDir(o.Dirname)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		v, err := strconv.ParseInt(o.FileVersionRegexp.FindString(e.Name()), 10, 64)
+		if err == nil && v >= version {
+			version = v + 1
+		}
+	}
+	return version, nil
 }
@@ -1,14 +1,25 @@
 package imigrate
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/bvinc/go-sqlite-lite/sqlite3"
@@ -100,6 +111,42 @@ func (o DB) GetVersions(query string, args ...interface{}) (versions []int64, er
 	return
 }
 
+// TxDB is a DB that satisfies Transactor.
+type TxDB struct {
+	*DB
+}
+
+func (o TxDB) Begin(ctx context.Context) (Tx, error) {
+	if err := o.Conn.Begin(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o DB) GetRows(ctx context.Context, query string, args ...interface{}) (rows [][]string, err error) {
+	stmt, err := o.Conn.Prepare(query, args...)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			return rows, nil
+		}
+		row := make([]string, stmt.ColumnCount())
+		for i := range row {
+			if row[i], _, err = stmt.ColumnText(i); err != nil {
+				return nil, err
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
 type FakeFSFileInfo struct {
 	name    string
 	size    int64
@@ -215,6 +262,14 @@ drop table bux;
 `),
 }
 
+// migrationSQL returns the contents of f.
+func migrationSQL(f *FakeFSFile) string {
+	f.Seek(0, 0)
+	b, err := ioutil.ReadAll(f)
+	check(err)
+	return string(b)
+}
+
 func TestIMigrateUpDown(t *testing.T) {
 	db := NewDB(":memory:")
 	defer db.Close()
@@ -275,7 +330,7 @@ func TestIMigrateUp(t *testing.T) {
 
 	mig.Down(-1, 0)
 	var count int
-	check(db.Get([]interface{}{&count}, "select count(*) from sqlite_master where type='table'"))
+	check(db.Get([]interface{}{&count}, "select count(*) from sqlite_master where type='table' and name not in (?, ?)", mig.TableName+"_lock", mig.HistoryTableName))
 	if count != 1 {
 		log.Fatalf("expected one table to exist, not %d", count)
 	}
@@ -285,7 +340,7 @@ func TestIMigrateUp(t *testing.T) {
 		log.Fatalf("Expected 0 migrations to exist after Down, got %d", count)
 	}
 	var migrationTable string
-	check(db.Get([]interface{}{&migrationTable}, "select name from sqlite_master where type='table'"))
+	check(db.Get([]interface{}{&migrationTable}, "select name from sqlite_master where type='table' and name not in (?, ?)", mig.TableName+"_lock", mig.HistoryTableName))
 
 	if migrationTable != mig.TableName {
 		t.Fatalf("Expected table %s to exist, got %s", mig.TableName, migrationTable)
@@ -311,6 +366,1182 @@ func TestIMigrateUp(t *testing.T) {
 	}
 
 }
+func TestIMigrateUpError(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	bad := NewFakeFSFile("1111110005-bad", `
+-- ==== UP ====
+create tabel oops;
+-- ==== DOWN ====
+`)
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], bad})
+	mig := NewIMigrator(db, fs)
+
+	err := mig.Up(-1, 0)
+	var migErr *MigrationError
+	if !errors.As(err, &migErr) {
+		t.Fatalf("expected a MigrationError, got %v", err)
+	}
+	if migErr.Phase != PhaseUp || migErr.Version != 1111110005 || migErr.File != "1111110005-bad" {
+		t.Fatalf("unexpected error fields %#v", migErr)
+	}
+	// Without a transaction the failed version is left dirty.
+	dirty, err := mig.getDirty(context.Background())
+	check(err)
+	if len(dirty) != 1 || dirty[0] != 1111110005 {
+		t.Fatalf("expected 1111110005 to be dirty, got %v", dirty)
+	}
+}
+
+func TestIMigrateSetupError(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("other", nil)
+	mig := NewIMigrator(db, fs)
+
+	_, err := mig.Status()
+	var migErr *MigrationError
+	if !errors.As(err, &migErr) || migErr.Phase != PhaseSetup {
+		t.Fatalf("expected a setup MigrationError, got %v", err)
+	}
+}
+
+func TestIMigrateUpContextCancelled(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"]})
+	mig := NewIMigrator(db, fs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := mig.UpContext(ctx, -1, 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	check(mig.UpContext(context.Background(), -1, 0))
+	versions, err := mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions after a fresh context, got %v", versions)
+	}
+}
+
+func TestIMigrateTransaction(t *testing.T) {
+	partial := NewFakeFSFile("1111110005-partial", `
+-- ==== UP ====
+create table partial (id integer primary key);
+create tabel oops;
+-- ==== DOWN ====
+drop table partial;
+`)
+	noTx := NewFakeFSFile("1111110005-partial", `
+-- imigrate: no-transaction
+-- ==== UP ====
+create table partial (id integer primary key);
+create tabel oops;
+-- ==== DOWN ====
+drop table partial;
+`)
+	tests := []struct {
+		file   *FakeFSFile
+		exists string
+		dirty  int
+	}{
+		{partial, "", 0},
+		{noTx, "partial", 1},
+	}
+	for _, tt := range tests {
+		db := NewDB(":memory:")
+		mig := NewIMigrator(TxDB{db}, NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], tt.file}))
+		if err := mig.Up(-1, 0); err == nil {
+			t.Fatal("expected Up to fail")
+		}
+		var tableName string
+		check(db.Get([]interface{}{&tableName}, "select name from sqlite_master where name='partial'"))
+		if tableName != tt.exists {
+			t.Fatalf("expected partial table to be %q, got %q", tt.exists, tableName)
+		}
+		versions, err := mig.getCompletedVersions(context.Background())
+		check(err)
+		if len(versions) != 1+tt.dirty {
+			t.Fatalf("expected only the first migration to be recorded, got %v", versions)
+		}
+		dirty, err := mig.getDirty(context.Background())
+		check(err)
+		if len(dirty) != tt.dirty {
+			t.Fatalf("expected %d dirty versions, got %v", tt.dirty, dirty)
+		}
+		db.Close()
+	}
+}
+
+func TestIMigrateLock(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"]})
+	mig := NewIMigrator(db, fs)
+	mig.LockTimeout = 10 * time.Millisecond
+	ctx := context.Background()
+	check(mig.setup(ctx))
+
+	other := SQLite.LockStrategy(mig.TableName)
+	locked, err := other.TryLock(ctx, WithContext(db))
+	check(err)
+	if !locked {
+		t.Fatal("expected to take the lock")
+	}
+	err = mig.Up(-1, 0)
+	var migErr *MigrationError
+	if !errors.As(err, &migErr) || migErr.Phase != PhaseLock || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a lock timeout, got %v", err)
+	}
+	mig.LockTimeout = 2*lockPollInterval + 50*time.Millisecond
+	buf, restore := captureLog()
+	err = mig.Up(-1, 0)
+	restore()
+	if !errors.Is(err, context.DeadlineExceeded) || strings.Count(buf.String(), "Waiting for migration lock") != 1 {
+		t.Fatalf("expected the wait to be logged once, got %v %q", err, buf)
+	}
+
+	mig.NoLock = true
+	check(mig.Up(-1, 0))
+	mig.NoLock = false
+	check(other.Unlock(ctx, WithContext(db)))
+
+	check(mig.Down(-1, 0))
+	locked, err = other.TryLock(ctx, WithContext(db))
+	check(err)
+	if !locked {
+		t.Fatal("expected Down to release the lock")
+	}
+}
+
+func TestIMigrateChecksum(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	mig1 := NewFakeFSFile("1111110001-mig1", migrationSQL(migrations["mig1"]))
+	fs := NewFakeFS("migrations", []*FakeFSFile{mig1, migrations["mig2"]})
+	mig := NewIMigrator(db, fs)
+	check(mig.Up(1, 0))
+
+	edited := NewFakeFSFile("1111110001-mig1", `
+-- ==== UP ====
+create table foo (id integer primary key, name text);
+-- ==== DOWN ====
+drop table foo;
+`)
+	fs = NewFakeFS("migrations", []*FakeFSFile{edited, migrations["mig2"]})
+	mig = NewIMigrator(db, fs)
+	mig.StrictChecksums = true
+	err := mig.Up(-1, 0)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	mismatches, err := mig.verifyChecksums(context.Background())
+	check(err)
+	if len(mismatches) != 1 || mismatches[0] != 1111110001 {
+		t.Fatalf("expected 1111110001 to mismatch, got %v", mismatches)
+	}
+
+	check(mig.Repair())
+	check(mig.Up(-1, 0))
+	versions, err := mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 2 {
+		t.Fatalf("expected both migrations after repair, got %v", versions)
+	}
+
+	// Without GetRows the checksums can't be read back.
+	fs = NewFakeFS("migrations", []*FakeFSFile{edited, migrations["mig2"], migrations["mig3"]})
+	mig = NewIMigrator(versionsOnlyDB{db}, fs)
+	mig.StrictChecksums = true
+	if err := mig.Up(-1, 0); err == nil || !strings.Contains(err.Error(), "RowGetter") {
+		t.Fatalf("expected StrictChecksums to require a RowGetter, got %v", err)
+	}
+}
+
+// versionsOnlyDB is an Executor without GetRows.
+type versionsOnlyDB struct {
+	db *DB
+}
+
+func (o versionsOnlyDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return o.db.Exec(query, args...)
+}
+
+func (o versionsOnlyDB) GetVersions(query string, args ...interface{}) ([]int64, error) {
+	return o.db.GetVersions(query, args...)
+}
+
+func TestIMigrateUpgradeTable(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	_, err := db.Exec("CREATE TABLE shmig_version (version integer primary key, migrated_at timestamp not null default (datetime(current_timestamp)))")
+	check(err)
+	_, err = db.Exec("INSERT INTO shmig_version (version) VALUES (1111110001)")
+	check(err)
+
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"]})
+	mig := NewIMigrator(db, fs)
+	mig.StrictChecksums = true
+	check(mig.Up(-1, 0))
+	check(mig.Up(-1, 0))
+	checksums, err := mig.getChecksums(context.Background())
+	check(err)
+	if checksums[1111110001] != "" || checksums[1111110002] == "" {
+		t.Fatalf("expected only the new migration to have a checksum, got %v", checksums)
+	}
+	records, err := mig.getRecords(context.Background())
+	check(err)
+	if records[1111110001].name != "" || records[1111110002].name != "mig2" {
+		t.Fatalf("expected only the new migration to have audit details, got %v", records)
+	}
+}
+
+func TestIMigrateGoMigration(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"]})
+	mig := NewIMigrator(TxDB{db}, fs)
+	var order []int64
+	mig.Register(1111110000, "go_first", func(db Executor) error {
+		order = append(order, 1111110000)
+		_, err := db.Exec("create table gofirst (id integer primary key)")
+		return err
+	}, func(db Executor) error {
+		_, err := db.Exec("drop table gofirst")
+		return err
+	})
+
+	check(mig.Up(1, 0))
+	var tableName string
+	check(db.Get([]interface{}{&tableName}, "select name from sqlite_master where name='gofirst'"))
+	if tableName != "gofirst" || len(order) != 1 {
+		t.Fatalf("expected the Go migration to run first, got %q %v", tableName, order)
+	}
+
+	check(mig.Up(-1, 0))
+	check(mig.Down(-1, 0))
+	tableName = ""
+	check(db.Get([]interface{}{&tableName}, "select name from sqlite_master where name='gofirst'"))
+	if tableName != "" {
+		t.Fatalf("expected the Go down migration to drop gofirst")
+	}
+
+	mig.Register(1111110003, "go_fails", func(db Executor) error {
+		if _, err := db.Exec("create table gofails (id integer primary key)"); err != nil {
+			return err
+		}
+		return errors.New("backfill failed")
+	}, nil)
+	err := mig.Up(-1, 0)
+	var migErr *MigrationError
+	if !errors.As(err, &migErr) || migErr.Version != 1111110003 || migErr.Phase != PhaseUp {
+		t.Fatalf("expected the Go migration error, got %v", err)
+	}
+	tableName = ""
+	check(db.Get([]interface{}{&tableName}, "select name from sqlite_master where name='gofails'"))
+	if tableName != "" {
+		t.Fatal("expected the failed Go migration to be rolled back")
+	}
+
+	dup := NewIMigrator(db, nil)
+	dup.Register(1111110009, "first", nil, nil)
+	dup.Register(1111110009, "second", nil, nil)
+	rejected, err := dup.Validate()
+	check(err)
+	if len(rejected) != 1 || rejected[0].Reason != RejectDuplicate {
+		t.Fatalf("expected the second Go migration to be rejected, got %v", rejected)
+	}
+	if err := dup.Up(-1, 0); !errors.Is(err, ErrDuplicateVersion) {
+		t.Fatalf("expected ErrDuplicateVersion, got %v", err)
+	}
+}
+
+func TestIMigrateIOFS(t *testing.T) {
+	files := fstest.MapFS{
+		"db/migrations/1111110001-mig1.sql": {Data: []byte(migrationSQL(migrations["mig1"]))},
+		"db/migrations/1111110002-mig2.sql": {Data: []byte(migrationSQL(migrations["mig2"]))},
+		"db/migrations/README":              {Data: []byte("not a migration")},
+		"db/migrations/1111110003-dir":      {Mode: fs.ModeDir},
+	}
+	sub, err := fs.Sub(files, "db")
+	check(err)
+	root, err := fs.Sub(files, "db/migrations")
+	check(err)
+	tests := []struct {
+		fsys    fs.FS
+		dirname string
+	}{
+		{files, "db/migrations"},
+		{sub, "migrations"},
+		{root, "."},
+	}
+	for _, tt := range tests {
+		db := NewDB(":memory:")
+		mig := NewIMigratorFS(db, tt.fsys)
+		mig.Dirname = tt.dirname
+		check(mig.Up(-1, 0))
+		versions, err := mig.getCompletedVersions(context.Background())
+		check(err)
+		if len(versions) != 2 || mig.Migrations[0].Name != "mig1" {
+			t.Fatalf("%s: expected 2 versions, got %v %#v", tt.dirname, versions, mig.Migrations)
+		}
+		db.Close()
+	}
+}
+
+// captureLog redirects Logger to a buffer until the returned function is
+// called.
+func captureLog() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	old := Logger
+	Logger = log.New(&buf, "", 0)
+	return &buf, func() { Logger = old }
+}
+
+func TestIMigrateDryRun(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"]})
+	mig := NewIMigrator(db, fs)
+	mig.DryRun = true
+
+	buf, restore := captureLog()
+	err := mig.Up(-1, 0)
+	restore()
+	check(err)
+	var count int
+	check(db.Get([]interface{}{&count}, "select count(*) from sqlite_master"))
+	if count != 0 {
+		t.Fatalf("expected a dry run not to create tables, got %d", count)
+	}
+	out := buf.String()
+	for _, s := range []string{"-- Dry run up 1111110001 (1111110001-mig1)", "create table foo", "create table bar", `INSERT INTO "shmig_version"`} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("expected dry run output to contain %q, got:\n%s", s, out)
+		}
+	}
+
+	mig.DryRun = false
+	check(mig.Up(-1, 0))
+	mig.DryRun = true
+	buf, restore = captureLog()
+	err = mig.Redo(1, 0)
+	restore()
+	check(err)
+	out = buf.String()
+	if !strings.Contains(out, "-- Dry run down 1111110002") || !strings.Contains(out, "-- Dry run up 1111110002") || !strings.Contains(out, `DELETE FROM "shmig_version"`) {
+		t.Fatalf("expected redo to print down and up of 1111110002, got:\n%s", out)
+	}
+	versions, err := mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 2 {
+		t.Fatalf("expected a dry run redo not to change versions, got %v", versions)
+	}
+
+	var records bytes.Buffer
+	mig.Log = slog.New(slog.NewJSONHandler(&records, nil))
+	buf, restore = captureLog()
+	err = mig.Rollback(1)
+	restore()
+	check(err)
+	if !strings.HasPrefix(buf.String(), "-- Dry run down 1111110002") || strings.Contains(records.String(), "Dry run") {
+		t.Fatalf("expected the dry run SQL to bypass Log, got output:\n%s\nrecords:\n%s", buf, &records)
+	}
+
+	var own bytes.Buffer
+	other := NewIMigrator(db, fs)
+	other.DryRun = true
+	other.DryRunOutput = &own
+	buf, restore = captureLog()
+	err = other.Rollback(1)
+	restore()
+	check(err)
+	if !strings.HasPrefix(own.String(), "-- Dry run down 1111110002") || strings.Contains(buf.String(), "Dry run") {
+		t.Fatalf("expected the dry run SQL in DryRunOutput only, got:\n%s\nLogger:\n%s", &own, buf)
+	}
+}
+
+func TestIMigrateGoto(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"], migrations["mig3"], migrations["mig4"]})
+	mig := NewIMigrator(db, fs)
+	ctx := context.Background()
+
+	tests := []struct {
+		target   int64
+		expected []int64
+	}{
+		{1111110002, []int64{1111110001, 1111110002}},
+		{1111110004, []int64{1111110001, 1111110002, 1111110003, 1111110004}},
+		{1111110001, []int64{1111110001}},
+		{0, nil},
+	}
+	for _, tt := range tests {
+		check(mig.Goto(tt.target))
+		versions, err := mig.getCompletedVersions(ctx)
+		check(err)
+		if fmt.Sprint(versions) != fmt.Sprint(tt.expected) {
+			t.Fatalf("goto %d: expected %v got %v", tt.target, tt.expected, versions)
+		}
+	}
+
+	if err := mig.Goto(1111110009); !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("expected ErrUnknownVersion, got %v", err)
+	}
+
+	// Nothing is reverted when a migration applied afterwards would fail.
+	for _, v := range []int64{1111110002, 1111110003, 1111110004} {
+		check(mig.Up(-1, v))
+	}
+	if err := mig.Goto(1111110003); !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("expected ErrOutOfOrder, got %v", err)
+	}
+	versions, err := mig.getCompletedVersions(ctx)
+	check(err)
+	if fmt.Sprint(versions) != "[1111110002 1111110003 1111110004]" {
+		t.Fatalf("expected nothing to be reverted, got %v", versions)
+	}
+}
+
+func TestIMigrateOutOfOrder(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"], migrations["mig4"]})
+	mig := NewIMigrator(db, fs)
+	check(mig.Up(-1, 0))
+
+	fs = NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"], migrations["mig3"], migrations["mig4"]})
+	mig = NewIMigrator(db, fs)
+	err := mig.Up(-1, 0)
+	var migErr *MigrationError
+	if !errors.Is(err, ErrOutOfOrder) || !errors.As(err, &migErr) || migErr.Phase != PhasePlan {
+		t.Fatalf("expected ErrOutOfOrder, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "1111110003") {
+		t.Fatalf("expected the error to list 1111110003, got %v", err)
+	}
+
+	report, err := mig.Status()
+	check(err)
+	if report.OutOfOrder != 1 || !report.Migrations[2].OutOfOrder || report.Migrations[1].OutOfOrder {
+		t.Fatalf("expected only 1111110003 to be out of order, got %#v", report.Migrations)
+	}
+
+	// Redo applies again what it reverted, and leaves the late migration pending.
+	check(mig.Redo(1, 0))
+	versions, err := mig.getCompletedVersions(context.Background())
+	check(err)
+	if fmt.Sprint(versions) != "[1111110001 1111110002 1111110004]" {
+		t.Fatalf("expected redo to apply 1111110004 again, got %v", versions)
+	}
+
+	mig.AllowOutOfOrder = true
+	check(mig.Up(-1, 0))
+	versions, err = mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 4 {
+		t.Fatalf("expected every migration to be applied, got %v", versions)
+	}
+}
+
+func TestIMigrateOrphan(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"], migrations["mig4"]})
+	mig := NewIMigrator(db, fs)
+	check(mig.Up(-1, 0))
+
+	fs = NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig4"]})
+	mig = NewIMigrator(db, fs)
+	report, err := mig.Status()
+	check(err)
+	if report.MissingFiles != 1 || report.Migrations[1].Version != 1111110002 || report.Migrations[1].State != StateMissingFile {
+		t.Fatalf("expected 1111110002 to be missing, got %#v", report.Migrations)
+	}
+
+	err = mig.Rollback(2)
+	var migErr *MigrationError
+	if !errors.Is(err, ErrMissingFile) || !errors.As(err, &migErr) || migErr.Version != 1111110002 {
+		t.Fatalf("expected ErrMissingFile for 1111110002, got %v", err)
+	}
+	versions, err := mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 3 {
+		t.Fatalf("expected nothing to be reverted, got %v", versions)
+	}
+	if err := mig.Down(0, 1111110002); !errors.Is(err, ErrMissingFile) {
+		t.Fatalf("expected ErrMissingFile, got %v", err)
+	}
+	if err := mig.Forget(1111110001); err == nil {
+		t.Fatal("expected forget to refuse a version with a file")
+	}
+
+	check(mig.Forget(1111110002))
+	check(mig.Down(-1, 0))
+	versions, err = mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 0 {
+		t.Fatalf("expected every version to be reverted, got %v", versions)
+	}
+}
+
+func TestIMigrateValidate(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	files := []*FakeFSFile{
+		migrations["mig1"],
+		NewFakeFSFile("notes.txt", "todo"),
+		NewFakeFSFile("1111110005-noup", "-- ==== U P ====\n-- ==== DOWN ====\n"),
+		NewFakeFSFile("1111110006-nodown", "-- ==== UP ====\ncreate table nodown (id integer);\n"),
+	}
+	dup := NewFakeFSFile("1111110001-zdup", migrationSQL(migrations["mig2"]))
+	mig := NewIMigrator(db, NewFakeFS("migrations", append(files, dup)))
+	rejected, err := mig.Validate()
+	check(err)
+	expected := map[string]RejectReason{
+		"notes.txt":         RejectNoVersion,
+		"1111110001-zdup":   RejectDuplicate,
+		"1111110005-noup":   RejectMissingUp,
+		"1111110006-nodown": RejectMissingDown,
+	}
+	if len(rejected) != len(expected) {
+		t.Fatalf("expected %d rejections, got %v", len(expected), rejected)
+	}
+	for _, r := range rejected {
+		if expected[r.File] != r.Reason {
+			t.Fatalf("expected %s to be rejected for %q, got %v", r.File, expected[r.File], r)
+		}
+	}
+
+	err = mig.Up(-1, 0)
+	if !errors.Is(err, ErrDuplicateVersion) || !strings.Contains(err.Error(), "1111110001-mig1 and 1111110001-zdup") {
+		t.Fatalf("expected ErrDuplicateVersion naming both files, got %v", err)
+	}
+
+	mig = NewIMigrator(db, NewFakeFS("migrations", files))
+	mig.StrictValidation = true
+	err = mig.Up(-1, 0)
+	if !errors.Is(err, ErrInvalidMigration) || !strings.Contains(err.Error(), "1111110005-noup") {
+		t.Fatalf("expected ErrInvalidMigration, got %v", err)
+	}
+
+	buf, restore := captureLog()
+	defer restore()
+	mig.StrictValidation = false
+	check(mig.Up(-1, 0))
+	if !strings.Contains(buf.String(), `Skipping file=1111110006-nodown reason="missing DOWN marker"`) {
+		t.Fatalf("expected rejected files to be logged, got %q", buf.String())
+	}
+	versions, err := mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 1 || versions[0] != 1111110001 {
+		t.Fatalf("expected only 1111110001 to be applied, got %v", versions)
+	}
+}
+
+// execLog records the queries passed to Exec.
+type execLog struct {
+	*DB
+	queries []string
+}
+
+func (o *execLog) Exec(query string, args ...interface{}) (sql.Result, error) {
+	o.queries = append(o.queries, query)
+	return o.DB.Exec(query, args...)
+}
+
+func TestIMigrateSplitStatements(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{NewFakeFSFile("1111110001-split", `
+-- ==== UP ====
+create table a (id integer primary key, n integer);
+create table b (id integer primary key);
+create trigger a_insert after insert on b
+begin
+	insert into a (n) values (new.id);
+end;
+-- ==== DOWN ====
+drop table b;
+drop table a;
+`)})
+	execs := &execLog{DB: db}
+	mig := NewIMigrator(execs, fs)
+	mig.SplitStatements = true
+	check(mig.Up(-1, 0))
+	var up []string
+	for _, q := range execs.queries {
+		if strings.HasPrefix(q, "create") {
+			up = append(up, q)
+		}
+	}
+	if len(up) != 3 || !strings.HasSuffix(up[2], "end") {
+		t.Fatalf("expected 3 statements, got %q", up)
+	}
+	_, err := db.Exec("insert into b (id) values (7)")
+	check(err)
+	var n int64
+	check(db.Get([]interface{}{&n}, "select n from a"))
+	if n != 7 {
+		t.Fatalf("expected the trigger to insert 7, got %d", n)
+	}
+	check(mig.Down(-1, 0))
+}
+
+func TestIMigrateDirectives(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{
+		migrations["mig1"],
+		NewFakeFSFile("1111110002-requires", `
+-- imigrate: requires=1111110001, timeout=5s
+-- imigrate: no-transaction
+-- ==== UP ====
+create table bar (id integer primary key);
+-- ==== DOWN ====
+drop table bar;
+`),
+		NewFakeFSFile("1111110003-irreversible", `
+-- imigrate: irreversible
+-- ==== UP ====
+drop table bar;
+-- ==== DOWN ====
+create table bar (id integer primary key);
+`),
+		NewFakeFSFile("1111110004-unknown", `
+-- imigrate: sometimes
+-- ==== UP ====
+-- ==== DOWN ====
+`),
+	})
+	mig := NewIMigrator(db, fs)
+	rejected, err := mig.Validate()
+	check(err)
+	if len(rejected) != 1 || rejected[0].Reason != RejectDirective {
+		t.Fatalf("expected the unknown directive to be rejected, got %v", rejected)
+	}
+	m, _ := mig.migration(1111110002)
+	if !m.NoTransaction || m.Timeout != 5*time.Second || len(m.Requires) != 1 || m.Requires[0] != 1111110001 {
+		t.Fatalf("unexpected directives %#v", m)
+	}
+	if m, _ := mig.migration(1111110003); !m.Irreversible {
+		t.Fatalf("expected 1111110003 to be irreversible")
+	}
+
+	if err := mig.Up(0, 1111110002); !errors.Is(err, ErrDependency) {
+		t.Fatalf("expected ErrDependency, got %v", err)
+	}
+	check(mig.Up(-1, 0))
+	if err := mig.Down(0, 1111110001); !errors.Is(err, ErrDependency) {
+		t.Fatalf("expected ErrDependency, got %v", err)
+	}
+	if err := mig.Rollback(2); !errors.Is(err, ErrIrreversible) {
+		t.Fatalf("expected ErrIrreversible, got %v", err)
+	}
+	versions, err := mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 3 {
+		t.Fatalf("expected nothing to be reverted, got %v", versions)
+	}
+
+	mig.Force = true
+	if err := mig.Redo(1, 0); !errors.Is(err, ErrIrreversible) {
+		t.Fatalf("expected Redo to refuse the irreversible migration, got %v", err)
+	}
+	versions, err = mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 3 {
+		t.Fatalf("expected nothing to be redone, got %v", versions)
+	}
+	check(mig.Rollback(1))
+	versions, err = mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 2 {
+		t.Fatalf("expected the irreversible version to be removed, got %v", versions)
+	}
+	if _, err := db.Exec("select * from bar"); err == nil {
+		t.Fatal("expected DOWN not to run")
+	}
+}
+
+func TestIMigrateBaseline(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	_, err := db.Exec("create table foo (id integer primary key); create table bar (id integer primary key)")
+	check(err)
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"], migrations["mig3"], migrations["mig4"]})
+	mig := NewIMigrator(db, fs)
+	if err := mig.Baseline(1111110009); !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("expected ErrUnknownVersion, got %v", err)
+	}
+	check(mig.Baseline(1111110002))
+	check(mig.Up(-1, 0))
+
+	report, err := mig.Status()
+	check(err)
+	if report.Baseline != 1111110002 || report.Applied != 4 {
+		t.Fatalf("expected a baseline at 1111110002, got %#v", report)
+	}
+	for _, s := range report.Migrations {
+		if s.Baseline != (s.Version <= 1111110002) {
+			t.Fatalf("unexpected baseline marker %#v", s)
+		}
+	}
+}
+
+func TestIMigrateHistory(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"]})
+	mig := NewIMigrator(db, fs)
+	mig.AppliedBy = "deploy@web1"
+	mig.BuildID = "v1.2.3"
+	check(mig.Baseline(1111110001))
+	check(mig.Up(-1, 0))
+
+	report, err := mig.Status()
+	check(err)
+	s := report.Migrations[1]
+	if s.AppliedBy != "deploy@web1" || s.BuildID != "v1.2.3" {
+		t.Fatalf("expected audit details in status, got %#v", s)
+	}
+
+	history, err := mig.History(HistoryFilter{})
+	check(err)
+	if len(history.Entries) != 2 {
+		t.Fatalf("expected 2 entries, got %#v", history.Entries)
+	}
+	first, second := history.Entries[0], history.Entries[1]
+	if first.Direction != DirectionBaseline || second.Direction != DirectionUp {
+		t.Fatalf("unexpected directions %#v", history.Entries)
+	}
+	if second.Name != "mig2" || second.File != "1111110002-mig2" || second.AppliedBy != "deploy@web1" || second.BuildID != "v1.2.3" || second.Checksum == "" || second.At == "" {
+		t.Fatalf("unexpected entry %#v", second)
+	}
+}
+
+func TestIMigrateHistoryTable(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	bad := NewFakeFSFile("1111110005-bad", `
+-- ==== UP ====
+create tabel oops;
+-- ==== DOWN ====
+`)
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"], bad})
+	mig := NewIMigrator(TxDB{db}, fs)
+	if err := mig.Up(-1, 0); err == nil {
+		t.Fatal("expected the bad migration to fail")
+	}
+	check(mig.Down(1, 0))
+
+	history, err := mig.History(HistoryFilter{})
+	check(err)
+	var got []string
+	for _, e := range history.Entries {
+		got = append(got, fmt.Sprint(e.Direction, " ", e.Version, " ", e.Outcome))
+	}
+	expected := []string{"up 1111110001 success", "up 1111110002 success", "up 1111110005 failure", "down 1111110002 success"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v got %v", expected, got)
+	}
+	if failed := history.Entries[2]; !strings.Contains(failed.Error, "tabel") || failed.File != "1111110005-bad" {
+		t.Fatalf("expected the error of the failed migration, got %#v", failed)
+	}
+
+	history, err = mig.History(HistoryFilter{Version: 1111110002})
+	check(err)
+	if len(history.Entries) != 2 {
+		t.Fatalf("expected 2 entries for 1111110002, got %#v", history.Entries)
+	}
+	history, err = mig.History(HistoryFilter{Since: time.Now().UTC().Add(-time.Hour), Until: time.Now().UTC().Add(time.Hour)})
+	check(err)
+	if len(history.Entries) != 4 {
+		t.Fatalf("expected every entry within the hour, got %#v", history.Entries)
+	}
+	history, err = mig.History(HistoryFilter{Since: time.Now().UTC().Add(time.Hour)})
+	check(err)
+	if len(history.Entries) != 0 {
+		t.Fatalf("expected no future entries, got %#v", history.Entries)
+	}
+
+	// A history table created later is seeded from the migrations table.
+	_, err = db.Exec("DROP TABLE shmig_version_history")
+	check(err)
+	mig = NewIMigrator(db, fs)
+	history, err = mig.History(HistoryFilter{})
+	check(err)
+	if len(history.Entries) != 1 || history.Entries[0].Version != 1111110001 || history.Entries[0].Direction != DirectionUp || history.Entries[0].Outcome != OutcomeSuccess {
+		t.Fatalf("expected the applied version to be seeded, got %#v", history.Entries)
+	}
+}
+
+func TestIMigrateDirty(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	bad := NewFakeFSFile("1111110005-bad", `
+-- ==== UP ====
+create table partial (id integer primary key);
+create tabel oops;
+-- ==== DOWN ====
+drop table partial;
+`)
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], bad})
+	mig := NewIMigrator(db, fs)
+	mig.SplitStatements = true
+	if err := mig.Up(-1, 0); errors.Is(err, ErrDirty) || err == nil {
+		t.Fatalf("expected the migration error, got %v", err)
+	}
+	for _, f := range []func() error{func() error { return mig.Up(-1, 0) }, func() error { return mig.Down(-1, 0) }} {
+		err := f()
+		var migErr *MigrationError
+		if !errors.Is(err, ErrDirty) || !errors.As(err, &migErr) || migErr.Version != 1111110005 {
+			t.Fatalf("expected ErrDirty for 1111110005, got %v", err)
+		}
+	}
+	report, err := mig.Status()
+	check(err)
+	if report.Dirty != 1 || report.Migrations[1].State != StateDirty {
+		t.Fatalf("expected 1111110005 to be dirty, got %#v", report)
+	}
+	var b bytes.Buffer
+	check(report.WriteText(&b))
+	if !strings.Contains(b.String(), "DIRTY 1111110005") {
+		t.Fatalf("expected the dirty version in the text report, got %q", b.String())
+	}
+
+	// The schema was repaired by hand to hold the whole migration.
+	check(mig.ForceState(1111110005, StateApplied))
+	report, err = mig.Status()
+	check(err)
+	if report.Dirty != 0 || report.Applied != 2 {
+		t.Fatalf("expected both versions applied, got %#v", report)
+	}
+	check(mig.Down(1, 0))
+
+	// Failing again, the migration is recorded as pending instead.
+	if err := mig.Up(-1, 0); err == nil {
+		t.Fatal("expected Up to fail again")
+	}
+	check(mig.ForceState(1111110005, StatePending))
+	if err := mig.ForceState(1111110009, StateApplied); !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("expected ErrUnknownVersion, got %v", err)
+	}
+	if err := mig.ForceState(1111110005, StateMissingFile); err == nil {
+		t.Fatal("expected an error for a state other than applied or pending")
+	}
+	versions, err := mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 1 || versions[0] != 1111110001 {
+		t.Fatalf("expected only 1111110001 to be applied, got %v", versions)
+	}
+	history, err := mig.History(HistoryFilter{Version: 1111110005})
+	check(err)
+	var got []Direction
+	for _, e := range history.Entries {
+		got = append(got, e.Direction)
+	}
+	expected := []Direction{DirectionUp, DirectionForceApplied, DirectionDown, DirectionUp, DirectionForcePending}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v got %v", expected, got)
+	}
+}
+
+func TestIMigrateHooks(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	bad := NewFakeFSFile("1111110005-bad", `
+-- ==== UP ====
+create tabel oops;
+-- ==== DOWN ====
+`)
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"], bad})
+	mig := NewIMigrator(TxDB{db}, fs)
+	var events []string
+	record := func(name string) HookFunc {
+		return func(ctx context.Context, e Event) error {
+			if e.Migration == nil {
+				events = append(events, fmt.Sprint(name, " ", e.Command, " ", e.Err != nil))
+			} else {
+				events = append(events, fmt.Sprint(name, " ", e.Command, " ", e.Direction, " ", e.Migration.Version))
+			}
+			return nil
+		}
+	}
+	veto := errors.New("not now")
+	mig.Hooks = Hooks{
+		BeforeAll:  record("before all"),
+		BeforeEach: record("before each"),
+		AfterEach:  record("after each"),
+		AfterAll:   record("after all"),
+		OnError: func(ctx context.Context, e Event) {
+			record("error")(ctx, e)
+		},
+	}
+	check(mig.Up(2, 0))
+	check(mig.Rollback(1))
+	if err := mig.Up(-1, 0); err == nil {
+		t.Fatal("expected the bad migration to fail")
+	}
+	expected := []string{
+		"before all up false",
+		"before each up up 1111110001", "after each up up 1111110001",
+		"before each up up 1111110002", "after each up up 1111110002",
+		"after all up false",
+		"before all rollback false",
+		"before each rollback down 1111110002", "after each rollback down 1111110002",
+		"after all rollback false",
+		"before all up false",
+		"before each up up 1111110002", "after each up up 1111110002",
+		"before each up up 1111110005", "error up up 1111110005",
+		"after all up true",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("expected %q got %q", expected, events)
+	}
+
+	// A hook's error aborts the run before the migration.
+	mig.Hooks.BeforeEach = func(ctx context.Context, e Event) error {
+		if e.Direction == DirectionDown {
+			return veto
+		}
+		return nil
+	}
+	err := mig.Down(-1, 0)
+	var migErr *MigrationError
+	if !errors.Is(err, veto) || !errors.As(err, &migErr) || migErr.Phase != PhaseHook || migErr.Version != 1111110002 {
+		t.Fatalf("expected the hook's error, got %v", err)
+	}
+	versions, err := mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 2 {
+		t.Fatalf("expected nothing to be reverted, got %v", versions)
+	}
+	mig.Hooks = Hooks{BeforeAll: func(ctx context.Context, e Event) error { return veto }}
+	if err := mig.Down(-1, 0); !errors.Is(err, veto) {
+		t.Fatalf("expected the hook's error, got %v", err)
+	}
+}
+
+func TestIMigrateLog(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"]})
+	var buf bytes.Buffer
+	mig := NewIMigrator(db, fs)
+	mig.Log = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	mig.LogLevel = slog.LevelDebug
+	quiet := NewIMigrator(db, fs)
+	quiet.LogLevel = LevelSilent
+
+	global, restore := captureLog()
+	defer restore()
+	check(quiet.Up(1, 0))
+	if global.Len() != 0 {
+		t.Fatalf("expected a silent migrator to log nothing, got %q", global.String())
+	}
+	check(mig.Up(-1, 0))
+	if global.Len() != 0 {
+		t.Fatalf("expected the migrator's own Log to be used, got %q", global.String())
+	}
+	var completed, debug int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]interface{}
+		check(json.Unmarshal([]byte(line), &rec))
+		if rec["level"] == "DEBUG" {
+			debug++
+		}
+		if rec["msg"] != "Up completed" {
+			continue
+		}
+		completed++
+		if rec["version"] != float64(1111110002) || rec["file"] != "1111110002-mig2" || rec["direction"] != "up" || rec["duration"] == nil || rec["rows_affected"] == nil {
+			t.Fatalf("expected structured fields, got %v", rec)
+		}
+	}
+	if completed != 1 || debug == 0 {
+		t.Fatalf("expected one completed migration and debug messages, got:\n%s", buf.String())
+	}
+
+	// DefaultLog writes key=value pairs to Logger.
+	check(mig.Down(1, 0))
+	mig.Log = nil
+	mig.LogLevel = slog.LevelInfo
+	check(mig.Up(-1, 0))
+	if out := global.String(); !strings.Contains(out, "Up completed version=1111110002 file=1111110002-mig2 direction=up duration=") || strings.Contains(out, "Running") {
+		t.Fatalf("expected an info message on Logger, got %q", out)
+	}
+}
+
+func TestIMigrateExplicitTransaction(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	old := NewFakeFSFile("1111110001-old", `
+-- ==== UP ====
+PRAGMA foreign_keys = ON;
+
+BEGIN;
+create table foo (id integer primary key);
+COMMIT;
+-- ==== DOWN ====
+PRAGMA foreign_keys = OFF;
+
+BEGIN;
+drop table foo;
+COMMIT;
+`)
+	mig := NewIMigrator(TxDB{db}, NewFakeFS("migrations", []*FakeFSFile{old, migrations["mig2"]}))
+	check(mig.Up(-1, 0))
+	if !mig.Migrations[0].NoTransaction || mig.Migrations[1].NoTransaction {
+		t.Fatalf("expected only the file with BEGIN to run without a transaction, got %#v", mig.Migrations)
+	}
+	check(mig.Rollback(2))
+	versions, err := mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 0 {
+		t.Fatalf("expected every version to be reverted, got %v", versions)
+	}
+}
+
+// outsideTxDB is a TxDB that records the queries run outside a transaction.
+type outsideTxDB struct {
+	TxDB
+	queries *[]string
+}
+
+func (o outsideTxDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	*o.queries = append(*o.queries, query)
+	return o.TxDB.Exec(query, args...)
+}
+
+func TestIMigrateDirtyOutsideTransaction(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	noTx := NewFakeFSFile("1111110002-no-tx", `
+-- imigrate: no-transaction
+-- ==== UP ====
+create table bar (id integer primary key);
+-- ==== DOWN ====
+drop table bar;
+`)
+	var queries []string
+	mig := NewIMigrator(outsideTxDB{TxDB{db}, &queries}, NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], noTx}))
+	check(mig.Up(-1, 0))
+	check(mig.Rollback(2))
+	var marked []string
+	for _, q := range queries {
+		if q == mig.insertDirtySQL() || q == mig.setDirtySQL() {
+			marked = append(marked, q)
+		}
+	}
+	if len(marked) != 2 {
+		t.Fatalf("expected only the no-transaction migration to be marked dirty outside its transaction, got %q", marked)
+	}
+}
+
+// slowAlterDB is a DB whose ALTER TABLE statements take a while, so two
+// migrators upgrading the migrations table at once would overlap.
+type slowAlterDB struct {
+	*DB
+}
+
+func (o slowAlterDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if strings.HasPrefix(query, "ALTER TABLE") {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return o.DB.Exec(query, args...)
+}
+
+func TestIMigrateConcurrentSetup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.db")
+	open := func() *DB {
+		conn, err := sqlite3.Open(path)
+		check(err)
+		conn.BusyTimeout(5 * time.Second)
+		return &DB{Conn: conn}
+	}
+	db := open()
+	defer db.Close()
+	// A migrations table from before the checksum, audit, dirty and history
+	// columns, so both migrators find it to upgrade.
+	_, err := db.Exec(`create table shmig_version (version integer primary key, migrated_at timestamp not null default (datetime(current_timestamp)));
+insert into shmig_version (version) values (1111110001);
+create table foo (id integer primary key);`)
+	check(err)
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			db := open()
+			defer db.Close()
+			fs := NewFakeFS("migrations", []*FakeFSFile{
+				NewFakeFSFile("1111110001-mig1", "-- ==== UP ====\ncreate table foo (id integer primary key);\n-- ==== DOWN ====\ndrop table foo;\n"),
+				NewFakeFSFile("1111110002-mig2", "-- ==== UP ====\ncreate table bar (id integer primary key);\n-- ==== DOWN ====\ndrop table bar;\n"),
+			})
+			errs <- NewIMigrator(slowAlterDB{db}, fs).Up(-1, 0)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		check(<-errs)
+	}
+	var count int
+	check(db.Get([]interface{}{&count}, "select count(*) from shmig_version_history"))
+	if count != 2 {
+		t.Fatalf("expected the history to be seeded once and to record one up, got %d entries", count)
+	}
+}
+
+// failingDB is a DB that records the statements that fail, and fails the
+// queries matched by fail.
+type failingDB struct {
+	*DB
+	fail   func(query string) bool
+	failed *[]string
+}
+
+func (o failingDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	res, err := o.DB.Exec(query, args...)
+	if err != nil {
+		*o.failed = append(*o.failed, query)
+	}
+	return res, err
+}
+
+func (o failingDB) GetVersions(query string, args ...interface{}) ([]int64, error) {
+	if o.fail != nil && o.fail(query) {
+		return nil, errors.New("connection reset")
+	}
+	versions, err := o.DB.GetVersions(query, args...)
+	if err != nil {
+		*o.failed = append(*o.failed, query)
+	}
+	return versions, err
+}
+
+func TestIMigrateSetupWithoutFailedStatements(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"]})
+	var failed []string
+	mig := NewIMigrator(failingDB{DB: db, failed: &failed}, fs)
+	check(mig.Up(-1, 0))
+	if len(failed) != 0 {
+		t.Fatalf("expected setup to check tables without failing statements, got %q", failed)
+	}
+
+	db2 := NewDB(":memory:")
+	defer db2.Close()
+	fail := func(query string) bool { return query == SQLite.ColumnExistsSQL() }
+	mig = NewIMigrator(failingDB{DB: db2, fail: fail, failed: &failed}, fs)
+	if err := mig.Up(-1, 0); err == nil || !strings.Contains(err.Error(), "checking column") {
+		t.Fatalf("expected the failed check to be returned, got %v", err)
+	}
+}
+
 func TestIMigrateDown(t *testing.T) {
 }
 func TestIMigrateRedo(t *testing.T) {
@@ -318,6 +1549,78 @@ func TestIMigrateRedo(t *testing.T) {
 func TestIMigrateRollback(t *testing.T) {
 }
 func TestIMigrateCreate(t *testing.T) {
+	dir := t.TempDir()
+	mig := NewIMigrator(nil, nil)
+	mig.Dirname = dir
+	check(mig.Create("first"))
+	check(mig.Create("second"))
+	check(mig.Create("first"))
+
+	reader := NewIMigrator(nil, http.Dir(dir))
+	reader.Dirname = "/"
+	rejected, err := reader.Validate()
+	check(err)
+	if len(rejected) != 0 {
+		t.Fatalf("expected no rejected files, got %v", rejected)
+	}
+	entries, err := os.ReadDir(dir)
+	check(err)
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		v := regexp.MustCompile(`^\d+`).FindString(e.Name())
+		if seen[v] {
+			t.Fatalf("expected unique versions, got %v", entries)
+		}
+		seen[v] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected 3 files, got %v", entries)
+	}
 }
 func TestIMigrateStatus(t *testing.T) {
+	db := NewDB(":memory:")
+	defer db.Close()
+	mig1 := NewFakeFSFile("1111110001-mig1", migrationSQL(migrations["mig1"]))
+	fs := NewFakeFS("migrations", []*FakeFSFile{mig1, migrations["mig2"], migrations["mig3"]})
+	mig := NewIMigrator(db, fs)
+	check(mig.Up(2, 0))
+	_, err := db.Exec("INSERT INTO shmig_version (version) VALUES (1111110000)")
+	check(err)
+	_, err = db.Exec("UPDATE shmig_version SET checksum = 'stale' WHERE version = 1111110002")
+	check(err)
+
+	report, err := mig.Status()
+	check(err)
+	expected := []struct {
+		version  int64
+		name     string
+		state    MigrationState
+		checksum ChecksumState
+	}{
+		{1111110000, "", StateMissingFile, ""},
+		{1111110001, "mig1", StateApplied, ChecksumOK},
+		{1111110002, "mig2", StateApplied, ChecksumMismatch},
+		{1111110003, "mig3", StatePending, ""},
+	}
+	if len(report.Migrations) != len(expected) {
+		t.Fatalf("expected %d migrations, got %#v", len(expected), report.Migrations)
+	}
+	for i, e := range expected {
+		s := report.Migrations[i]
+		if s.Version != e.version || s.Name != e.name || s.State != e.state || s.Checksum != e.checksum {
+			t.Fatalf("expected %#v got %#v", e, s)
+		}
+		if s.State != StatePending && s.MigratedAt == "" {
+			t.Fatalf("expected migrated_at for %d", s.Version)
+		}
+	}
+	if report.Applied != 2 || report.Pending != 1 || report.MissingFiles != 1 || report.ChecksumMismatches != 1 {
+		t.Fatalf("unexpected counts %#v", report)
+	}
+
+	var buf bytes.Buffer
+	check(report.WriteText(&buf))
+	if !strings.Contains(buf.String(), "Pending 1111110003\n") || !strings.Contains(buf.String(), "Checksum mismatch 1111110002\n") {
+		t.Fatalf("unexpected text report %q", buf.String())
+	}
 }
@@ -0,0 +1,128 @@
+package imigrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Locker is implemented by Executors that take the migration lock themselves.
+// Lock blocks until the lock is held or ctx is done. When the DB given to
+// IMigrator implements Locker, the dialect's LockStrategy is not used.
+type Locker interface {
+	Lock(ctx context.Context) error
+	Unlock(ctx context.Context) error
+}
+
+// Session is a single database connection.
+type Session interface {
+	Executor
+	Close() error
+}
+
+// Sessioner is implemented by Executors backed by a connection pool. Advisory
+// locks belong to the connection that took them, so they are taken on a
+// dedicated Session that stays open for the whole run. The pool must allow at
+// least two connections.
+type Sessioner interface {
+	Session(ctx context.Context) (Session, error)
+}
+
+// DefaultLockTimeout is the LockTimeout set by NewIMigrator. It outlasts
+// tableLockTTL, so a stale SQLite lock is broken before the wait fails.
+const DefaultLockTimeout = 10 * time.Minute
+
+// lockPollInterval is how often TryLock is retried while another migrator
+// holds the lock.
+const lockPollInterval = 250 * time.Millisecond
+
+// lock acquires the migration lock and returns the function that releases
+// it. The lock is skipped when NoLock or DryRun is set or the dialect has no
+// LockStrategy.
+func (o *IMigrator) lock(ctx context.Context) (unlock func(), err error) {
+	unlock = func() {}
+	if o.NoLock || o.DryRun {
+		return
+	}
+	lockCtx := ctx
+	if o.LockTimeout > 0 {
+		var cancel context.CancelFunc
+		lockCtx, cancel = context.WithTimeout(ctx, o.LockTimeout)
+		defer cancel()
+	}
+
+	if l, ok := o.DB.(Locker); ok {
+		if err = l.Lock(lockCtx); err != nil {
+			return unlock, newError(PhaseLock, nil, err)
+		}
+		return func() {
+			if err := l.Unlock(context.Background()); err != nil {
+				o.log().Error("Unlock failed", "error", err)
+			}
+		}, nil
+	}
+
+	strategy := o.dialect().LockStrategy(o.TableName)
+	if strategy == nil {
+		return
+	}
+	db := o.db()
+	closeSession := func() {}
+	// A lock row is visible to every connection, so only session-level locks
+	// need a dedicated connection.
+	_, rowLock := strategy.(tableLock)
+	if s, ok := o.DB.(Sessioner); ok && !rowLock {
+		session, err := s.Session(ctx)
+		if err != nil {
+			return unlock, newError(PhaseLock, nil, err)
+		}
+		db = WithContext(session)
+		closeSession = func() { session.Close() }
+	}
+	for waited := false; ; waited = true {
+		locked, err := strategy.TryLock(lockCtx, db)
+		if err != nil {
+			closeSession()
+			return unlock, newError(PhaseLock, nil, err)
+		}
+		if locked {
+			break
+		}
+		if !waited {
+			o.log().Info("Waiting for migration lock")
+		}
+		select {
+		case <-lockCtx.Done():
+			closeSession()
+			return unlock, newError(PhaseLock, nil, fmt.Errorf("waiting for migration lock: %w", lockCtx.Err()))
+		case <-time.After(lockPollInterval):
+		}
+	}
+	if r, ok := strategy.(lockRefresher); ok {
+		o.refreshLock = func(ctx context.Context) error { return r.Refresh(ctx, db) }
+	}
+	return func() {
+		o.refreshLock = nil
+		if err := strategy.Unlock(context.Background(), db); err != nil {
+			o.log().Error("Unlock failed", "error", err)
+		}
+		closeSession()
+	}, nil
+}
+
+// lockRefresher is implemented by LockStrategies whose lock expires unless it
+// is refreshed, so the lock of a crashed process doesn't last forever.
+type lockRefresher interface {
+	Refresh(ctx context.Context, db ExecutorContext) error
+}
+
+// keepLock refreshes an expiring lock before each migration, so a long run
+// doesn't lose it.
+func (o IMigrator) keepLock(ctx context.Context) {
+	if o.refreshLock == nil {
+		return
+	}
+	if err := o.refreshLock(ctx); err != nil {
+		o.log().Warn("Migration lock not refreshed", "error", err)
+	}
+}
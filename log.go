@@ -0,0 +1,136 @@
+package imigrate
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// LevelSilent is a LogLevel above every slog level, so nothing is logged.
+const LevelSilent = slog.LevelError + 4
+
+// LevelLogger is the leveled, structured logger IMigrator writes to. Its
+// methods take alternating keys and values like slog, so a *slog.Logger
+// satisfies it.
+type LevelLogger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// DefaultLog is used by migrators without a Log. It writes each record as
+// the message followed by key=value pairs to the package Logger, so it keeps
+// following Logger when that is replaced.
+var DefaultLog LevelLogger = slog.New(loggerHandler{})
+
+// levelLogger drops the records of l below min.
+type levelLogger struct {
+	l   LevelLogger
+	min slog.Level
+}
+
+func (o levelLogger) Debug(msg string, args ...any) {
+	if o.min <= slog.LevelDebug {
+		o.l.Debug(msg, args...)
+	}
+}
+
+func (o levelLogger) Info(msg string, args ...any) {
+	if o.min <= slog.LevelInfo {
+		o.l.Info(msg, args...)
+	}
+}
+
+func (o levelLogger) Warn(msg string, args ...any) {
+	if o.min <= slog.LevelWarn {
+		o.l.Warn(msg, args...)
+	}
+}
+
+func (o levelLogger) Error(msg string, args ...any) {
+	if o.min <= slog.LevelError {
+		o.l.Error(msg, args...)
+	}
+}
+
+// log returns Log, or DefaultLog, filtered by LogLevel.
+func (o IMigrator) log() LevelLogger {
+	l := o.Log
+	if l == nil {
+		l = DefaultLog
+	}
+	return levelLogger{l: l, min: o.LogLevel}
+}
+
+// migrationAttrs returns the log fields that identify m.
+func migrationAttrs(m Migration, direction Direction) []any {
+	attrs := []any{"version", m.Version}
+	if name := m.fileName(); name != "" {
+		attrs = append(attrs, "file", name)
+	}
+	return append(attrs, "direction", string(direction))
+}
+
+// loggerHandler is the slog.Handler of DefaultLog. Levels are filtered by
+// IMigrator, so every record is written.
+type loggerHandler struct {
+	attrs  []slog.Attr
+	prefix string // The open groups, joined by dots.
+}
+
+func (loggerHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (o loggerHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	for _, a := range o.attrs {
+		writeAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&b, o.prefix, a)
+		return true
+	})
+	return Logger.Output(2, b.String())
+}
+
+func (o loggerHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	for _, a := range attrs {
+		a.Key = o.prefix + a.Key
+		o.attrs = append(o.attrs[:len(o.attrs):len(o.attrs)], a)
+	}
+	return o
+}
+
+func (o loggerHandler) WithGroup(name string) slog.Handler {
+	if name != "" {
+		o.prefix += name + "."
+	}
+	return o
+}
+
+// writeAttr writes a as key=value, quoting values that hold spaces.
+func writeAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, g := range v.Group() {
+			writeAttr(b, prefix, g)
+		}
+		return
+	}
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	s := fmt.Sprint(v.Any())
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		s = strconv.Quote(s)
+	}
+	fmt.Fprintf(b, " %s%s=%s", prefix, a.Key, s)
+}
@@ -0,0 +1,68 @@
+package imigrate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// appliedDescending returns the applied versions, newest first.
+func appliedDescending(applied map[int64]bool) []int64 {
+	var versions []int64
+	for v, ok := range applied {
+		if ok {
+			versions = append(versions, v)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+	return versions
+}
+
+// orphans returns the applied versions that have no migration, such as
+// migrations whose file was deleted or renamed, oldest first.
+func (o IMigrator) orphans(applied map[int64]bool) []int64 {
+	var versions []int64
+	for _, v := range appliedDescending(applied) {
+		if !o.hasVersion(v) {
+			versions = append([]int64{v}, versions...)
+		}
+	}
+	return versions
+}
+
+func orphanError(version int64) error {
+	return &MigrationError{Phase: PhasePlan, Version: version, Err: fmt.Errorf("%w, run forget to remove it", ErrMissingFile)}
+}
+
+// Forget deletes version from the migrations table without running any SQL.
+// It only accepts applied versions whose migration file is missing; use Down
+// to revert a migration that still exists.
+func (o *IMigrator) Forget(version int64) error {
+	return o.ForgetContext(context.Background(), version)
+}
+
+// ForgetContext is like Forget but stops with the context's error once ctx is
+// done.
+func (o *IMigrator) ForgetContext(ctx context.Context, version int64) error {
+	return o.run(ctx, func(applied map[int64]bool) error {
+		if !applied[version] {
+			return newError(PhasePlan, nil, fmt.Errorf("%w: %d is not applied", ErrUnknownVersion, version))
+		}
+		if m, ok := o.migration(version); ok {
+			return newError(PhasePlan, &m, fmt.Errorf("migration file exists, use down to revert it"))
+		}
+		if o.DryRun {
+			o.dryRunf("-- Dry run forget %d", version)
+			o.dryRunf("%s; -- %v", o.deleteVersionSQL(), []interface{}{version})
+			return nil
+		}
+		if _, err := o.db().ExecContext(ctx, o.deleteVersionSQL(), version); err != nil {
+			err = &MigrationError{Phase: PhaseRecord, Version: version, Err: err}
+			o.appendHistory(Migration{Version: version}, DirectionForget, 0, err)
+			return err
+		}
+		o.appendHistory(Migration{Version: version}, DirectionForget, 0, nil)
+		o.log().Info("Migration forgotten", "version", version)
+		return nil
+	})
+}
@@ -0,0 +1,219 @@
+package imigrate
+
+import "strings"
+
+// StatementBreak is a line that ends a statement when SQL is split, for
+// statements whose end a Splitter can't find on its own.
+const StatementBreak = "-- +statementbreak"
+
+// Splitter splits the SQL of a migration into statements that can be run one
+// Exec at a time. Statements end at a semicolon outside string literals,
+// quoted identifiers, comments and BEGIN ... END or CASE ... END blocks, and
+// at a StatementBreak line. BEGIN opens a block only at the start of a
+// statement, unless it starts a transaction, inside another block, or after
+// AS, FOR EACH ROW, a closing parenthesis or the head of a CREATE TRIGGER.
+type Splitter struct {
+	DollarQuotes     bool   // Treat PostgreSQL $tag$ ... $tag$ as a string literal.
+	EscapeStrings    bool   // Allow a backslash to escape a quote inside a PostgreSQL E'...' string literal.
+	BackslashEscapes bool   // Allow a backslash to escape a quote inside a string literal, as MySQL does.
+	HashComments     bool   // Treat # to the end of the line as a comment, as MySQL does.
+	BatchSeparator   string // When set, statements end only at a line holding just this word and maybe a -- comment, like GO for MSSQL, and semicolons are left in place.
+}
+
+// Split returns the statements in query without their trailing semicolons.
+// Statements holding only comments are dropped.
+func (o Splitter) Split(query string) []string {
+	var stmts []string
+	start, depth := 0, 0
+	code, lineStart := false, true
+	flush := func(end, next int) {
+		if s := strings.TrimSpace(query[start:end]); code && s != "" {
+			stmts = append(stmts, s)
+		}
+		start, code, depth = next, false, 0
+	}
+	for i := 0; i < len(query); {
+		if lineStart {
+			lineStart = false
+			end := lineEnd(query, i)
+			line := strings.TrimSpace(query[i:end])
+			if line == StatementBreak || o.isBatchSeparator(line) {
+				flush(i, end)
+				i = end
+				continue
+			}
+		}
+		c := query[i]
+		switch {
+		case c == '\n':
+			lineStart = true
+			i++
+		case strings.HasPrefix(query[i:], "--") || c == '#' && o.HashComments:
+			i = lineEnd(query, i)
+		case strings.HasPrefix(query[i:], "/*"):
+			if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+				i += 2 + end + 2
+			} else {
+				i = len(query)
+			}
+		case c == '\'':
+			i = skipQuoted(query, i, c, o.BackslashEscapes)
+			code = true
+		case c == '"' || c == '`':
+			i = skipQuoted(query, i, c, false)
+			code = true
+		case c == '$' && o.DollarQuotes:
+			tag := dollarTag(query[i:])
+			if tag == "" {
+				i++
+			} else if end := strings.Index(query[i+len(tag):], tag); end >= 0 {
+				i += len(tag) + end + len(tag)
+			} else {
+				i = len(query)
+			}
+			code = true
+		case c == ';' && o.BatchSeparator == "" && depth == 0:
+			flush(i, i+1)
+			i++
+		case o.EscapeStrings && (c == 'E' || c == 'e') && i+1 < len(query) && query[i+1] == '\'':
+			i = skipQuoted(query, i+1, '\'', true)
+			code = true
+		case isIdentStart(c):
+			j := wordEnd(query, i)
+			word := strings.ToUpper(query[i:j])
+			next := nextWord(query[j:])
+			switch {
+			case word == "BEGIN" && (depth > 0 || beginsBlock(query[start:i], code, query[j:])):
+				depth++
+			case word == "CASE":
+				depth++
+			case word == "END" && (next == "IF" || next == "LOOP" || next == "WHILE" || next == "REPEAT"):
+				// Ends a control statement that didn't open a block.
+			case word == "END" && depth > 0:
+				depth--
+				if next == "CASE" {
+					// Skip the CASE of END CASE so it doesn't open a block.
+					j = wordEnd(query, len(query)-len(strings.TrimLeft(query[j:], " \t\r\n")))
+				}
+			}
+			i = j
+			code = true
+		default:
+			if c != ' ' && c != '\t' && c != '\r' {
+				code = true
+			}
+			i++
+		}
+	}
+	flush(len(query), len(query))
+	return stmts
+}
+
+// isBatchSeparator reports whether line holds just the BatchSeparator,
+// maybe followed by a -- comment.
+func (o Splitter) isBatchSeparator(line string) bool {
+	if o.BatchSeparator == "" {
+		return false
+	}
+	if end := strings.Index(line, "--"); end >= 0 {
+		line = strings.TrimSpace(line[:end])
+	}
+	return strings.EqualFold(line, o.BatchSeparator)
+}
+
+// beginsBlock reports whether a BEGIN outside any block, preceded by stmt in
+// its statement and followed by rest, opens a block. code tells whether stmt
+// holds more than comments.
+func beginsBlock(stmt string, code bool, rest string) bool {
+	if !code {
+		return !isTransactionBegin(rest)
+	}
+	if strings.HasSuffix(strings.TrimRight(stmt, " \t\r\n"), ")") {
+		// The body of a MySQL procedure or function.
+		return true
+	}
+	words := strings.Fields(strings.ToUpper(stmt))
+	n := len(words)
+	switch {
+	case words[n-1] == "AS":
+		return true
+	case n >= 3 && words[n-3] == "FOR" && words[n-2] == "EACH" && words[n-1] == "ROW":
+		return true
+	}
+	// CREATE [TEMP|TEMPORARY] TRIGGER, whose BEGIN may follow a table name
+	// or a WHEN clause.
+	for _, w := range words[1:min(n, 3)] {
+		if w == "TRIGGER" {
+			return words[0] == "CREATE"
+		}
+	}
+	return false
+}
+
+// lineEnd returns the index of the newline ending the line at i, or the
+// length of s.
+func lineEnd(s string, i int) int {
+	if end := strings.IndexByte(s[i:], '\n'); end >= 0 {
+		return i + end
+	}
+	return len(s)
+}
+
+// skipQuoted returns the index after the literal starting with the quote at
+// s[i]. A doubled quote is part of the literal.
+func skipQuoted(s string, i int, quote byte, backslash bool) int {
+	for j := i + 1; j < len(s); j++ {
+		switch {
+		case backslash && s[j] == '\\':
+			j++
+		case s[j] == quote && j+1 < len(s) && s[j+1] == quote:
+			j++
+		case s[j] == quote:
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+// dollarTag returns the $tag$ at the start of s, or "" if there is none.
+func dollarTag(s string) string {
+	j := 1
+	if j < len(s) && isIdentStart(s[j]) {
+		j = wordEnd(s, j)
+	}
+	if j < len(s) && s[j] == '$' {
+		return s[:j+1]
+	}
+	return ""
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func wordEnd(s string, i int) int {
+	for i < len(s) && (isIdentStart(s[i]) || '0' <= s[i] && s[i] <= '9') {
+		i++
+	}
+	return i
+}
+
+// nextWord returns the upper cased word after any spaces at the start of s,
+// or "" if s continues with something else.
+func nextWord(s string) string {
+	s = strings.TrimLeft(s, " \t\r\n")
+	return strings.ToUpper(s[:wordEnd(s, 0)])
+}
+
+// isTransactionBegin reports whether the BEGIN followed by s starts a
+// transaction rather than a block.
+func isTransactionBegin(s string) bool {
+	if rest := strings.TrimLeft(s, " \t\r\n"); rest == "" || rest[0] == ';' {
+		return true
+	}
+	switch nextWord(s) {
+	case "TRANSACTION", "TRAN", "WORK", "DEFERRED", "IMMEDIATE", "EXCLUSIVE", "ISOLATION", "READ", "NOT", "DEFERRABLE":
+		return true
+	}
+	return false
+}
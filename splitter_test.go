@@ -0,0 +1,53 @@
+package imigrate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		splitter Splitter
+		sql      string
+		expected []string
+	}{
+		{"semicolons", Splitter{}, "create table a (id int);\ncreate table b (id int);\n", []string{"create table a (id int)", "create table b (id int)"}},
+		{"no trailing semicolon", Splitter{}, "select 1; select 2", []string{"select 1", "select 2"}},
+		{"string literal", Splitter{}, "insert into a values ('x;''y');select 1;", []string{"insert into a values ('x;''y')", "select 1"}},
+		{"quoted identifier", Splitter{}, `create table "a;b" (id int); select 1`, []string{`create table "a;b" (id int)`, "select 1"}},
+		{"comments", Splitter{}, "-- first; not a break\nselect 1; /* a;\nb */ select 2;\n-- trailing comment\n", []string{"-- first; not a break\nselect 1", "/* a;\nb */ select 2"}},
+		{"trigger", Splitter{}, `
+create trigger t after insert on a
+begin
+	update b set n = n + 1;
+	insert into c values (1);
+end;
+select 1;`, []string{"create trigger t after insert on a\nbegin\n\tupdate b set n = n + 1;\n\tinsert into c values (1);\nend", "select 1"}},
+		{"case", Splitter{}, "select case when 1 then 'a' else 'b' end; select 2", []string{"select case when 1 then 'a' else 'b' end", "select 2"}},
+		{"transaction begin", Splitter{}, "begin; select 1; begin transaction; commit;", []string{"begin", "select 1", "begin transaction", "commit"}},
+		{"statement break", Splitter{}, "create procedure p() begin select 1\n-- +statementbreak\nselect 2", []string{"create procedure p() begin select 1", "select 2"}},
+		{"dollar quotes", Splitter{DollarQuotes: true}, "create function f() returns int as $body$ begin return 1; end $body$ language plpgsql;\nselect $1::int;", []string{"create function f() returns int as $body$ begin return 1; end $body$ language plpgsql", "select $1::int"}},
+		{"backslash escapes", Splitter{BackslashEscapes: true}, `insert into a values ('it\'s;'); select 1`, []string{`insert into a values ('it\'s;')`, "select 1"}},
+		{"mysql control flow", Splitter{BackslashEscapes: true}, "create procedure p() begin if 1 then select 1; end if; case when 1 then select 2; end case; end;\nselect 3;", []string{"create procedure p() begin if 1 then select 1; end if; case when 1 then select 2; end case; end", "select 3"}},
+		{"batch separator", Splitter{BatchSeparator: "GO"}, "create table a (id int);\ninsert into a values (1);\ngo\ncreate procedure p as select 1;\nGO\n", []string{"create table a (id int);\ninsert into a values (1);", "create procedure p as select 1;"}},
+		{"only comments", Splitter{}, "-- nothing to do\n", nil},
+		{"hash comment", Splitter{BackslashEscapes: true, HashComments: true}, "# it's a comment; still\nselect 1; select 2;", []string{"# it's a comment; still\nselect 1", "select 2"}},
+		{"begin isolation level", Splitter{}, "BEGIN ISOLATION LEVEL SERIALIZABLE; select 1; COMMIT;", []string{"BEGIN ISOLATION LEVEL SERIALIZABLE", "select 1", "COMMIT"}},
+		{"begin as a column", Splitter{}, "create table t (begin int); select 1;", []string{"create table t (begin int)", "select 1"}},
+		{"begin after as", Splitter{}, "create procedure p as begin select 1; select 2; end; select 3;", []string{"create procedure p as begin select 1; select 2; end", "select 3"}},
+		{"begin after for each row", Splitter{}, "create trigger t before insert on a for each row begin set new.n = 1; end; select 1;", []string{"create trigger t before insert on a for each row begin set new.n = 1; end", "select 1"}},
+		{"trigger with when", Splitter{}, "create temp trigger t after update on a when new.n > 1 begin delete from b; end; select 1;", []string{"create temp trigger t after update on a when new.n > 1 begin delete from b; end", "select 1"}},
+		{"nested begin", Splitter{BackslashEscapes: true}, "create procedure p() begin begin select 1; end; select 2; end; select 3;", []string{"create procedure p() begin begin select 1; end; select 2; end", "select 3"}},
+		{"batch separator comment", Splitter{BatchSeparator: "GO"}, "select 1;\nGO -- first batch\nselect 2;\n", []string{"select 1;", "select 2;"}},
+		{"escape string", Splitter{DollarQuotes: true, EscapeStrings: true}, `insert into a values (E'it\'s; x'); select 1`, []string{`insert into a values (E'it\'s; x')`, "select 1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.splitter.Split(tt.sql)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected %q got %q", tt.expected, got)
+			}
+		})
+	}
+}
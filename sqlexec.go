@@ -0,0 +1,155 @@
+package imigrate
+
+import (
+	"context"
+	"database/sql"
+)
+
+// SQLConn is the part of database/sql used by SQLExecutor. It is satisfied by
+// *sql.DB, *sql.Conn and *sql.Tx.
+type SQLConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type sqlBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// SQLExecutor adapts a database/sql connection to Executor, ExecutorContext,
+// RowGetter, Transactor and Sessioner.
+//
+// When Conn is a *sql.Tx the caller owns the transaction, so Begin returns a
+// Tx whose Commit and Rollback do nothing.
+type SQLExecutor struct {
+	Conn SQLConn
+}
+
+// NewSQLExecutor returns an SQLExecutor for a *sql.DB, *sql.Conn or *sql.Tx.
+func NewSQLExecutor(conn SQLConn) *SQLExecutor {
+	return &SQLExecutor{Conn: conn}
+}
+
+// Exec executes query with a background context.
+func (o *SQLExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return o.ExecContext(context.Background(), query, args...)
+}
+
+// GetVersions runs query with a background context and scans the first column
+// of every row as an int64.
+func (o *SQLExecutor) GetVersions(query string, args ...interface{}) ([]int64, error) {
+	return o.GetVersionsContext(context.Background(), query, args...)
+}
+
+// ExecContext executes query.
+func (o *SQLExecutor) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return o.Conn.ExecContext(ctx, query, args...)
+}
+
+// GetVersionsContext runs query and scans the first column of every row as an
+// int64.
+func (o *SQLExecutor) GetVersionsContext(ctx context.Context, query string, args ...interface{}) (versions []int64, err error) {
+	rows, err := o.Conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int64
+		if err = rows.Scan(&version); err != nil {
+			return
+		}
+		versions = append(versions, version)
+	}
+	err = rows.Err()
+	return
+}
+
+// GetRows runs query and returns every column as a string.
+func (o *SQLExecutor) GetRows(ctx context.Context, query string, args ...interface{}) (result [][]string, err error) {
+	rows, err := o.Conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		vals := make([]sql.NullString, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return
+		}
+		row := make([]string, len(cols))
+		for i, v := range vals {
+			row[i] = v.String
+		}
+		result = append(result, row)
+	}
+	err = rows.Err()
+	return
+}
+
+// Begin starts a transaction on Conn.
+func (o *SQLExecutor) Begin(ctx context.Context) (Tx, error) {
+	b, ok := o.Conn.(sqlBeginner)
+	if !ok {
+		return sqlTx{SQLExecutor: o}, nil
+	}
+	tx, err := b.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sqlTx{SQLExecutor: NewSQLExecutor(tx), tx: tx}, nil
+}
+
+// Session returns an SQLExecutor bound to a single connection from Conn's
+// pool. When Conn is already a single connection the session uses it
+// directly and Close does nothing.
+func (o *SQLExecutor) Session(ctx context.Context) (Session, error) {
+	db, ok := o.Conn.(*sql.DB)
+	if !ok {
+		return sqlSession{SQLExecutor: o}, nil
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sqlSession{SQLExecutor: NewSQLExecutor(conn), conn: conn}, nil
+}
+
+type sqlSession struct {
+	*SQLExecutor
+	conn *sql.Conn
+}
+
+func (o sqlSession) Close() error {
+	if o.conn == nil {
+		return nil
+	}
+	return o.conn.Close()
+}
+
+type sqlTx struct {
+	*SQLExecutor
+	tx *sql.Tx
+}
+
+func (o sqlTx) Commit() error {
+	if o.tx == nil {
+		return nil
+	}
+	return o.tx.Commit()
+}
+
+func (o sqlTx) Rollback() error {
+	if o.tx == nil {
+		return nil
+	}
+	return o.tx.Rollback()
+}
@@ -0,0 +1,153 @@
+package imigrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"testing"
+
+	"github.com/bvinc/go-sqlite-lite/sqlite3"
+)
+
+// liteDriver is a minimal database/sql driver on top of go-sqlite-lite, used
+// to exercise SQLExecutor without linking a second copy of SQLite.
+type liteDriver struct{}
+
+func (liteDriver) Open(name string) (driver.Conn, error) {
+	conn, err := sqlite3.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &liteConn{conn}, nil
+}
+
+type liteConn struct {
+	*sqlite3.Conn
+}
+
+func (o *liteConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := o.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &liteStmt{stmt}, nil
+}
+
+func (o *liteConn) Begin() (driver.Tx, error) {
+	return o, o.Conn.Begin()
+}
+
+func (o *liteConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	if err := o.Conn.Exec(query, values(args)...); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(o.Changes()), nil
+}
+
+type liteStmt struct {
+	*sqlite3.Stmt
+}
+
+func (o *liteStmt) NumInput() int {
+	return o.BindParameterCount()
+}
+
+func (o *liteStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, o.Stmt.Exec(values(args)...)
+}
+
+func (o *liteStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &liteRows{o}, o.Bind(values(args)...)
+}
+
+type liteRows struct {
+	*liteStmt
+}
+
+func (o *liteRows) Columns() []string {
+	return o.ColumnNames()
+}
+
+func (o *liteRows) Next(dest []driver.Value) error {
+	hasRow, err := o.Step()
+	if err != nil {
+		return err
+	}
+	if !hasRow {
+		return io.EOF
+	}
+	vals := make([]interface{}, len(dest))
+	ptrs := make([]interface{}, len(dest))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	if err := o.Scan(ptrs...); err != nil {
+		return err
+	}
+	for i, v := range vals {
+		dest[i] = v
+	}
+	return nil
+}
+
+func (o *liteRows) Close() error {
+	return nil
+}
+
+func values(args []driver.Value) []interface{} {
+	vals := make([]interface{}, len(args))
+	for i, a := range args {
+		vals[i] = a
+	}
+	return vals
+}
+
+func init() {
+	sql.Register("sqlite-lite", liteDriver{})
+}
+
+func openSQL() *sql.DB {
+	db, err := sql.Open("sqlite-lite", ":memory:")
+	check(err)
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func TestSQLExecutor(t *testing.T) {
+	db := openSQL()
+	defer db.Close()
+	fs := NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"], migrations["mig2"]})
+	mig := NewIMigrator(NewSQLExecutor(db), fs)
+
+	check(mig.Up(-1, 0))
+	versions, err := mig.getCompletedVersions(context.Background())
+	check(err)
+	if len(versions) != 2 || versions[0] != 1111110001 || versions[1] != 1111110002 {
+		t.Fatalf("expected both versions to be applied, got %v", versions)
+	}
+
+	check(mig.Rollback(1))
+	var name string
+	err = db.QueryRow("select name from sqlite_master where name='bar'").Scan(&name)
+	if err != sql.ErrNoRows {
+		t.Fatalf("expected bar to be dropped, got %q %v", name, err)
+	}
+}
+
+func TestSQLExecutorTx(t *testing.T) {
+	db := openSQL()
+	defer db.Close()
+	tx, err := db.Begin()
+	check(err)
+
+	mig := NewIMigrator(NewSQLExecutor(tx), NewFakeFS("migrations", []*FakeFSFile{migrations["mig1"]}))
+	check(mig.Up(-1, 0))
+	check(tx.Rollback())
+
+	var count int
+	check(db.QueryRow("select count(*) from sqlite_master").Scan(&count))
+	if count != 0 {
+		t.Fatalf("expected the caller's rollback to undo the migration, got %d tables", count)
+	}
+}
@@ -0,0 +1,169 @@
+// Package sqlitelite adapts github.com/bvinc/go-sqlite-lite connections to
+// the imigrate Executor interfaces. It lives in its own package so that
+// importing imigrate does not require cgo.
+package sqlitelite
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/sandro/imigrate"
+)
+
+// Executor adapts a *sqlite3.Conn to imigrate.Executor,
+// imigrate.ExecutorContext, imigrate.RowGetter and imigrate.Transactor.
+type Executor struct {
+	Conn *sqlite3.Conn
+}
+
+// NewExecutor returns an Executor for conn.
+func NewExecutor(conn *sqlite3.Conn) *Executor {
+	return &Executor{Conn: conn}
+}
+
+type result struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (o result) LastInsertId() (int64, error) {
+	return o.lastInsertID, nil
+}
+
+func (o result) RowsAffected() (int64, error) {
+	return o.rowsAffected, nil
+}
+
+// Exec executes query, which may contain several statements.
+func (o *Executor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if err := o.Conn.Exec(query, args...); err != nil {
+		return nil, err
+	}
+	return result{
+		lastInsertID: o.Conn.LastInsertRowID(),
+		rowsAffected: int64(o.Conn.Changes()),
+	}, nil
+}
+
+// GetVersions runs query and scans the first column of every row as an int64.
+func (o *Executor) GetVersions(query string, args ...interface{}) (versions []int64, err error) {
+	stmt, err := o.Conn.Prepare(query, args...)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var version int64
+		if err = stmt.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return
+}
+
+// GetRows runs query and returns every column as a string.
+func (o *Executor) GetRows(ctx context.Context, query string, args ...interface{}) (rows [][]string, err error) {
+	err = o.interruptible(ctx, func() error {
+		stmt, err := o.Conn.Prepare(query, args...)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for {
+			hasRow, err := stmt.Step()
+			if err != nil {
+				return err
+			}
+			if !hasRow {
+				return nil
+			}
+			row := make([]string, stmt.ColumnCount())
+			for i := range row {
+				if row[i], _, err = stmt.ColumnText(i); err != nil {
+					return err
+				}
+			}
+			rows = append(rows, row)
+		}
+	})
+	return
+}
+
+// ExecContext is like Exec but interrupts the statement when ctx is done.
+func (o *Executor) ExecContext(ctx context.Context, query string, args ...interface{}) (res sql.Result, err error) {
+	err = o.interruptible(ctx, func() (err error) {
+		res, err = o.Exec(query, args...)
+		return
+	})
+	return
+}
+
+// GetVersionsContext is like GetVersions but interrupts the query when ctx is
+// done.
+func (o *Executor) GetVersionsContext(ctx context.Context, query string, args ...interface{}) (versions []int64, err error) {
+	err = o.interruptible(ctx, func() (err error) {
+		versions, err = o.GetVersions(query, args...)
+		return
+	})
+	return
+}
+
+// interruptible runs f, calling Conn.Interrupt if ctx is done before f
+// returns.
+func (o *Executor) interruptible(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return f()
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			o.Conn.Interrupt()
+		case <-done:
+		}
+	}()
+	err := f()
+	close(done)
+	<-finished
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Begin starts a deferred transaction.
+func (o *Executor) Begin(ctx context.Context) (imigrate.Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := o.Conn.Begin(); err != nil {
+		return nil, err
+	}
+	return tx{o}, nil
+}
+
+type tx struct {
+	*Executor
+}
+
+func (o tx) Commit() error {
+	return o.Conn.Commit()
+}
+
+func (o tx) Rollback() error {
+	return o.Conn.Rollback()
+}
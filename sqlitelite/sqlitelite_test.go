@@ -0,0 +1,68 @@
+package sqlitelite
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/sandro/imigrate"
+)
+
+func newMigrator(t *testing.T, files map[string]string) (*imigrate.IMigrator, *sqlite3.Conn) {
+	dir := t.TempDir()
+	check(t, os.Mkdir(filepath.Join(dir, "migrations"), 0755))
+	for name, content := range files {
+		check(t, ioutil.WriteFile(filepath.Join(dir, "migrations", name), []byte(content), 0644))
+	}
+	conn, err := sqlite3.Open(":memory:")
+	check(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return imigrate.NewIMigrator(NewExecutor(conn), http.Dir(dir)), conn
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecutor(t *testing.T) {
+	mig, conn := newMigrator(t, map[string]string{
+		"1111110001-foo.sql": "-- ==== UP ====\ncreate table foo (id integer primary key);\n-- ==== DOWN ====\ndrop table foo;\n",
+		"1111110002-bad.sql": "-- ==== UP ====\ncreate table bar (id integer primary key);\ncreate tabel oops;\n-- ==== DOWN ====\ndrop table bar;\n",
+	})
+	if err := mig.Up(-1, 0); err == nil {
+		t.Fatal("expected the second migration to fail")
+	}
+	versions, err := NewExecutor(conn).GetVersions("select version from shmig_version")
+	check(t, err)
+	if len(versions) != 1 || versions[0] != 1111110001 {
+		t.Fatalf("expected only 1111110001 to be applied, got %v", versions)
+	}
+	tables, err := NewExecutor(conn).GetVersions("select count(*) from sqlite_master where name='bar'")
+	check(t, err)
+	if tables[0] != 0 {
+		t.Fatal("expected the failed migration to be rolled back")
+	}
+}
+
+func TestExecutorContextInterrupt(t *testing.T) {
+	conn, err := sqlite3.Open(":memory:")
+	check(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = NewExecutor(conn).ExecContext(ctx, `
+WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c)
+SELECT count(*) FROM c;`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the query to be interrupted, got %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package imigrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// MigrationState is the state of a migration in a StatusReport.
+type MigrationState string
+
+const (
+	StateApplied     MigrationState = "applied"      // Recorded in the migrations table.
+	StatePending     MigrationState = "pending"      // Not yet applied.
+	StateMissingFile MigrationState = "missing-file" // Recorded in the migrations table, but no migration has its version.
+	StateDirty       MigrationState = "dirty"        // UP or DOWN failed part way through. Repair the schema, then use ForceState.
+)
+
+// ChecksumState compares an applied migration with its recorded checksum.
+type ChecksumState string
+
+const (
+	ChecksumOK       ChecksumState = "ok"       // The migration matches the recorded checksum.
+	ChecksumMismatch ChecksumState = "mismatch" // The migration changed after it was applied.
+	ChecksumUnknown  ChecksumState = "unknown"  // No checksum was recorded, or the DB cannot read it back.
+)
+
+// MigrationStatus describes one migration in a StatusReport. MigratedAt is
+// formatted by the database and is empty unless the migration is applied and
+// the DB implements RowGetter, as are DurationMS, AppliedBy and BuildID.
+// OutOfOrder is set on pending migrations older than the newest applied one.
+// Baseline is set on versions recorded by Baseline rather than run.
+type MigrationStatus struct {
+	Version    int64          `json:"version"`
+	Name       string         `json:"name"`
+	File       string         `json:"file,omitempty"`
+	State      MigrationState `json:"state"`
+	OutOfOrder bool           `json:"out_of_order,omitempty"`
+	Baseline   bool           `json:"baseline,omitempty"`
+	MigratedAt string         `json:"migrated_at,omitempty"`
+	Checksum   ChecksumState  `json:"checksum,omitempty"`
+	DurationMS int64          `json:"duration_ms,omitempty"`
+	AppliedBy  string         `json:"applied_by,omitempty"`
+	BuildID    string         `json:"build_id,omitempty"`
+}
+
+// StatusReport is returned by Status. Migrations are sorted by version.
+// Baseline is the newest version recorded by Baseline, or zero.
+type StatusReport struct {
+	Migrations         []MigrationStatus `json:"migrations"`
+	Baseline           int64             `json:"baseline,omitempty"`
+	Applied            int               `json:"applied"`
+	Pending            int               `json:"pending"`
+	MissingFiles       int               `json:"missing_files"`
+	Dirty              int               `json:"dirty"`
+	OutOfOrder         int               `json:"out_of_order"`
+	ChecksumMismatches int               `json:"checksum_mismatches"`
+}
+
+func (o *StatusReport) add(s MigrationStatus) {
+	o.Migrations = append(o.Migrations, s)
+	switch s.State {
+	case StateApplied:
+		o.Applied++
+	case StatePending:
+		o.Pending++
+	case StateMissingFile:
+		o.MissingFiles++
+	case StateDirty:
+		o.Dirty++
+	}
+	if s.OutOfOrder {
+		o.OutOfOrder++
+	}
+	if s.Baseline && s.Version > o.Baseline {
+		o.Baseline = s.Version
+	}
+	if s.Checksum == ChecksumMismatch {
+		o.ChecksumMismatches++
+	}
+}
+
+// WriteText writes the report in the log format printed by earlier versions
+// of Status. Dirty versions are listed first.
+func (o *StatusReport) WriteText(w io.Writer) error {
+	lines := []string{"STATUS"}
+	for _, s := range o.Migrations {
+		if s.State == StateDirty {
+			lines = append(lines, fmt.Sprint("DIRTY ", s.Version, ": repair the schema, then run force"))
+		}
+	}
+	for _, s := range o.Migrations {
+		switch s.State {
+		case StateApplied:
+			if s.Baseline {
+				lines = append(lines, fmt.Sprint("Migration Completed ", s.Version, " (baseline)"))
+			} else {
+				lines = append(lines, fmt.Sprint("Migration Completed ", s.Version))
+			}
+		case StatePending:
+			if s.OutOfOrder {
+				lines = append(lines, fmt.Sprint("Pending ", s.Version, " (out of order)"))
+			} else {
+				lines = append(lines, fmt.Sprint("Pending ", s.Version))
+			}
+		case StateMissingFile:
+			lines = append(lines, fmt.Sprint("Missing file ", s.Version))
+		}
+	}
+	for _, s := range o.Migrations {
+		if s.Checksum == ChecksumMismatch {
+			lines = append(lines, fmt.Sprint("Checksum mismatch ", s.Version))
+		}
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the report as a JSON object.
+func (o *StatusReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(o)
+}
+
+// WriteTable writes the report as an aligned table.
+func (o *StatusReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATE\tMIGRATED AT\tCHECKSUM")
+	for _, s := range o.Migrations {
+		state := string(s.State)
+		if s.OutOfOrder {
+			state += " (out of order)"
+		}
+		if s.Baseline {
+			state += " (baseline)"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", s.Version, s.Name, state, s.MigratedAt, s.Checksum)
+	}
+	fmt.Fprintf(tw, "\n%d applied, %d pending, %d out of order, %d missing files, %d checksum mismatches\n", o.Applied, o.Pending, o.OutOfOrder, o.MissingFiles, o.ChecksumMismatches)
+	if o.Dirty > 0 {
+		fmt.Fprintf(tw, "%d dirty, repair the schema then run force\n", o.Dirty)
+	}
+	return tw.Flush()
+}
+
+// Status reports which migrations have been run and which are pending.
+func (o *IMigrator) Status() (*StatusReport, error) {
+	return o.StatusContext(context.Background())
+}
+
+// StatusContext is like Status but stops with the context's error once ctx is
+// done.
+func (o *IMigrator) StatusContext(ctx context.Context) (*StatusReport, error) {
+	if err := o.setupLocked(ctx); err != nil {
+		return nil, err
+	}
+	versions, err := o.getCompletedVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	records, err := o.getRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	checksums, err := o.getChecksums(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dirty, err := o.getDirty(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	isDirty := make(map[int64]bool, len(dirty))
+	for _, v := range dirty {
+		isDirty[v] = true
+	}
+	applied := make(map[int64]bool, len(versions))
+	for _, v := range versions {
+		applied[v] = true
+	}
+	late := make(map[int64]bool)
+	for _, v := range o.outOfOrder(applied) {
+		late[v] = true
+	}
+	var statuses []MigrationStatus
+	for _, m := range o.Migrations {
+		s := MigrationStatus{
+			Version:    m.Version,
+			Name:       m.Name,
+			File:       m.fileName(),
+			State:      StatePending,
+			OutOfOrder: late[m.Version],
+		}
+		if applied[m.Version] {
+			s.State = StateApplied
+			records[m.Version].fill(&s)
+			switch sum := checksums[m.Version]; {
+			case sum == "":
+				s.Checksum = ChecksumUnknown
+			case sum == m.Checksum():
+				s.Checksum = ChecksumOK
+			default:
+				s.Checksum = ChecksumMismatch
+			}
+		}
+		if isDirty[m.Version] {
+			s.State = StateDirty
+		}
+		statuses = append(statuses, s)
+	}
+	for _, v := range o.orphans(applied) {
+		// The recorded name and file help find the missing migration.
+		s := MigrationStatus{Version: v, State: StateMissingFile}
+		records[v].fill(&s)
+		s.Name, s.File = records[v].name, records[v].file
+		if isDirty[v] {
+			s.State = StateDirty
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	report := &StatusReport{Migrations: []MigrationStatus{}}
+	for _, s := range statuses {
+		report.add(s)
+	}
+	return report, nil
+}
+
+// record is a row of the migrations table.
+type record struct {
+	migratedAt string // Formatted by the database.
+	baseline   bool
+	name       string
+	file       string
+	durationMS int64
+	appliedBy  string
+	buildID    string
+}
+
+// fill copies the recorded details of an applied migration into s.
+func (o record) fill(s *MigrationStatus) {
+	s.MigratedAt = o.migratedAt
+	s.Baseline = o.baseline
+	s.DurationMS = o.durationMS
+	s.AppliedBy = o.appliedBy
+	s.BuildID = o.buildID
+}
+
+// getRecords returns the row of every applied version. It returns nil when
+// the DB is not a RowGetter.
+func (o IMigrator) getRecords(ctx context.Context) (map[int64]record, error) {
+	rg, ok := o.DB.(RowGetter)
+	if !ok {
+		return nil, nil
+	}
+	d := o.dialect()
+	columns := []string{o.column(), "migrated_at", d.QuoteIdent(o.BaselineColumn)}
+	for _, c := range auditColumns {
+		columns = append(columns, d.QuoteIdent(c.name))
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), o.table())
+	rows, err := rg.GetRows(ctx, query)
+	if err != nil {
+		return nil, newError(PhaseStatus, nil, err)
+	}
+	records := make(map[int64]record, len(rows))
+	for _, row := range rows {
+		v, err := strconv.ParseInt(row[0], 10, 64)
+		if err != nil {
+			return nil, newError(PhaseStatus, nil, err)
+		}
+		// A duration is missing for versions recorded by older versions.
+		duration, _ := strconv.ParseInt(row[5], 10, 64)
+		records[v] = record{
+			migratedAt: row[1],
+			baseline:   row[2] == "1",
+			name:       row[3],
+			file:       row[4],
+			durationMS: duration,
+			appliedBy:  row[6],
+			buildID:    row[7],
+		}
+	}
+	return records, nil
+}
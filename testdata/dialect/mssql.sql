@@ -0,0 +1,50 @@
+-- create table
+IF OBJECT_ID(N'shmig_version', N'U') IS NULL
+CREATE TABLE [shmig_version] (
+	[version] bigint primary key,
+	[migrated_at] datetime2 not null default current_timestamp
+);
+-- select versions
+SELECT [version] FROM [shmig_version] ORDER BY [version]
+-- insert version
+INSERT INTO [shmig_version] ([version], [checksum], [baseline], [name], [file], [duration_ms], [applied_by], [build_id], [dirty]) VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7, @p8, 0)
+-- delete version
+DELETE FROM [shmig_version] WHERE [version] = @p1
+-- insert dirty version
+INSERT INTO [shmig_version] ([version], [checksum], [baseline], [name], [file], [duration_ms], [applied_by], [build_id], [dirty]) VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7, @p8, 1)
+-- complete up
+UPDATE [shmig_version] SET [dirty] = 0, [duration_ms] = @p1 WHERE [version] = @p2
+-- set dirty
+UPDATE [shmig_version] SET [dirty] = @p1 WHERE [version] = @p2
+-- column exists
+SELECT COUNT(*) FROM sys.columns WHERE object_id = OBJECT_ID(QUOTENAME(@p1)) AND name = @p2
+-- create history table
+IF OBJECT_ID(N'shmig_version_history', N'U') IS NULL
+CREATE TABLE [shmig_version_history] (
+	[id] bigint identity primary key,
+	[version] bigint not null,
+	[direction] varchar(16) not null,
+	[name] nvarchar(255),
+	[file] nvarchar(255),
+	[checksum] varchar(64),
+	[recorded_at] datetime2 not null default current_timestamp,
+	[duration_ms] bigint,
+	[outcome] varchar(16) not null,
+	[error] nvarchar(max),
+	[applied_by] nvarchar(255),
+	[build_id] nvarchar(255)
+);
+-- insert history
+INSERT INTO [shmig_version_history] ([version], [direction], [name], [file], [checksum], [duration_ms], [outcome], [error], [applied_by], [build_id]) VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7, @p8, @p9, @p10)
+-- lock
+DECLARE @result int;
+EXEC @result = sp_getapplock @Resource = N'shmig_version', @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = 0;
+SELECT CASE WHEN @result >= 0 THEN 1 ELSE 0 END
+-- unlock
+EXEC sp_releaseapplock @Resource = N'shmig_version', @LockOwner = 'Session'
+-- template up
+
+-- template down
+
+-- splitter
+{DollarQuotes:false EscapeStrings:false BackslashEscapes:false HashComments:false BatchSeparator:GO}
@@ -0,0 +1,46 @@
+-- create table
+CREATE TABLE IF NOT EXISTS `shmig_version` (
+	`version` bigint primary key,
+	`migrated_at` timestamp not null default current_timestamp
+);
+-- select versions
+SELECT `version` FROM `shmig_version` ORDER BY `version`
+-- insert version
+INSERT INTO `shmig_version` (`version`, `checksum`, `baseline`, `name`, `file`, `duration_ms`, `applied_by`, `build_id`, `dirty`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0)
+-- delete version
+DELETE FROM `shmig_version` WHERE `version` = ?
+-- insert dirty version
+INSERT INTO `shmig_version` (`version`, `checksum`, `baseline`, `name`, `file`, `duration_ms`, `applied_by`, `build_id`, `dirty`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1)
+-- complete up
+UPDATE `shmig_version` SET `dirty` = 0, `duration_ms` = ? WHERE `version` = ?
+-- set dirty
+UPDATE `shmig_version` SET `dirty` = ? WHERE `version` = ?
+-- column exists
+SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?
+-- create history table
+CREATE TABLE IF NOT EXISTS `shmig_version_history` (
+	`id` bigint auto_increment primary key,
+	`version` bigint not null,
+	`direction` varchar(16) not null,
+	`name` varchar(255),
+	`file` varchar(255),
+	`checksum` varchar(64),
+	`recorded_at` timestamp not null default current_timestamp,
+	`duration_ms` bigint,
+	`outcome` varchar(16) not null,
+	`error` text,
+	`applied_by` varchar(255),
+	`build_id` varchar(255)
+);
+-- insert history
+INSERT INTO `shmig_version_history` (`version`, `direction`, `name`, `file`, `checksum`, `duration_ms`, `outcome`, `error`, `applied_by`, `build_id`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+-- lock
+SELECT COALESCE(GET_LOCK('shmig_version', 0), 0)
+-- unlock
+SELECT RELEASE_LOCK('shmig_version')
+-- template up
+
+-- template down
+
+-- splitter
+{DollarQuotes:false EscapeStrings:false BackslashEscapes:true HashComments:true BatchSeparator:}
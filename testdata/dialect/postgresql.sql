@@ -0,0 +1,46 @@
+-- create table
+CREATE TABLE IF NOT EXISTS "shmig_version" (
+	"version" bigint primary key,
+	"migrated_at" timestamp not null default current_timestamp
+);
+-- select versions
+SELECT "version" FROM "shmig_version" ORDER BY "version"
+-- insert version
+INSERT INTO "shmig_version" ("version", "checksum", "baseline", "name", "file", "duration_ms", "applied_by", "build_id", "dirty") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 0)
+-- delete version
+DELETE FROM "shmig_version" WHERE "version" = $1
+-- insert dirty version
+INSERT INTO "shmig_version" ("version", "checksum", "baseline", "name", "file", "duration_ms", "applied_by", "build_id", "dirty") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 1)
+-- complete up
+UPDATE "shmig_version" SET "dirty" = 0, "duration_ms" = $1 WHERE "version" = $2
+-- set dirty
+UPDATE "shmig_version" SET "dirty" = $1 WHERE "version" = $2
+-- column exists
+SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2
+-- create history table
+CREATE TABLE IF NOT EXISTS "shmig_version_history" (
+	"id" bigserial primary key,
+	"version" bigint not null,
+	"direction" varchar(16) not null,
+	"name" varchar(255),
+	"file" varchar(255),
+	"checksum" varchar(64),
+	"recorded_at" timestamp not null default current_timestamp,
+	"duration_ms" bigint,
+	"outcome" varchar(16) not null,
+	"error" text,
+	"applied_by" varchar(255),
+	"build_id" varchar(255)
+);
+-- insert history
+INSERT INTO "shmig_version_history" ("version", "direction", "name", "file", "checksum", "duration_ms", "outcome", "error", "applied_by", "build_id") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+-- lock
+SELECT CASE WHEN pg_try_advisory_lock(4985347795571175826) THEN 1 ELSE 0 END
+-- unlock
+SELECT pg_advisory_unlock(4985347795571175826)
+-- template up
+
+-- template down
+
+-- splitter
+{DollarQuotes:true EscapeStrings:true BackslashEscapes:false HashComments:false BatchSeparator:}
@@ -0,0 +1,52 @@
+-- create table
+CREATE TABLE IF NOT EXISTS "shmig_version" (
+	"version" integer primary key,
+	"migrated_at" timestamp not null default (datetime(current_timestamp))
+);
+-- select versions
+SELECT "version" FROM "shmig_version" ORDER BY "version"
+-- insert version
+INSERT INTO "shmig_version" ("version", "checksum", "baseline", "name", "file", "duration_ms", "applied_by", "build_id", "dirty") VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0)
+-- delete version
+DELETE FROM "shmig_version" WHERE "version" = ?
+-- insert dirty version
+INSERT INTO "shmig_version" ("version", "checksum", "baseline", "name", "file", "duration_ms", "applied_by", "build_id", "dirty") VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1)
+-- complete up
+UPDATE "shmig_version" SET "dirty" = 0, "duration_ms" = ? WHERE "version" = ?
+-- set dirty
+UPDATE "shmig_version" SET "dirty" = ? WHERE "version" = ?
+-- column exists
+SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?
+-- create history table
+CREATE TABLE IF NOT EXISTS "shmig_version_history" (
+	"id" integer primary key,
+	"version" integer not null,
+	"direction" varchar(16) not null,
+	"name" varchar(255),
+	"file" varchar(255),
+	"checksum" varchar(64),
+	"recorded_at" timestamp not null default (datetime(current_timestamp)),
+	"duration_ms" bigint,
+	"outcome" varchar(16) not null,
+	"error" text,
+	"applied_by" varchar(255),
+	"build_id" varchar(255)
+);
+-- insert history
+INSERT INTO "shmig_version_history" ("version", "direction", "name", "file", "checksum", "duration_ms", "outcome", "error", "applied_by", "build_id") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+-- create lock table
+CREATE TABLE IF NOT EXISTS "shmig_version_lock" (id integer primary key, owner varchar(255) not null, expires_at integer not null, locked_at timestamp not null default (datetime(current_timestamp)))
+-- break stale lock
+DELETE FROM "shmig_version_lock" WHERE id = 1 AND expires_at < CAST(strftime('%s', 'now') AS integer)
+-- lock
+INSERT OR IGNORE INTO "shmig_version_lock" (id, owner, expires_at) VALUES (1, ?, CAST(strftime('%s', 'now') AS integer) + 300)
+-- refresh lock
+UPDATE "shmig_version_lock" SET expires_at = CAST(strftime('%s', 'now') AS integer) + 300 WHERE id = 1 AND owner = ?
+-- unlock
+DELETE FROM "shmig_version_lock" WHERE id = 1 AND owner = ?
+-- template up
+PRAGMA foreign_keys = ON;
+-- template down
+PRAGMA foreign_keys = OFF;
+-- splitter
+{DollarQuotes:false EscapeStrings:false BackslashEscapes:false HashComments:false BatchSeparator:}
@@ -0,0 +1,81 @@
+package imigrate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RejectReason explains why a migration file was rejected.
+type RejectReason string
+
+const (
+	RejectNoVersion   RejectReason = "no version prefix"
+	RejectMissingUp   RejectReason = "missing UP marker"
+	RejectMissingDown RejectReason = "missing DOWN marker"
+	RejectDuplicate   RejectReason = "duplicate version"
+	RejectUnreadable  RejectReason = "unreadable"
+	RejectDirective   RejectReason = "invalid directive"
+)
+
+// Rejection is a file in the migrations directory, or a registered Go
+// migration, that is not loaded as a migration.
+type Rejection struct {
+	File    string // Empty for Go migrations.
+	Version int64  // Zero when the file has no version prefix.
+	Reason  RejectReason
+	Err     error // More detail, such as the read error. May be nil.
+}
+
+func (o Rejection) String() string {
+	name := o.File
+	if name == "" {
+		name = fmt.Sprintf("version %d", o.Version)
+	}
+	if o.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", name, o.Reason, o.Err)
+	}
+	return fmt.Sprintf("%s: %s", name, o.Reason)
+}
+
+func (o *IMigrator) reject(file string, version int64, reason RejectReason, err error) {
+	o.Rejected = append(o.Rejected, Rejection{File: file, Version: version, Reason: reason, Err: err})
+}
+
+// checkRejected logs the rejected files, or fails when StrictValidation is
+// set. An unreadable file always fails, as it did before files were
+// validated.
+func (o IMigrator) checkRejected() error {
+	if len(o.Rejected) == 0 {
+		return nil
+	}
+	for _, r := range o.Rejected {
+		if r.Reason == RejectUnreadable {
+			return &MigrationError{Phase: PhaseRead, Version: r.Version, File: r.File, Err: r.Err}
+		}
+	}
+	if o.StrictValidation {
+		list := make([]string, len(o.Rejected))
+		for i, r := range o.Rejected {
+			list[i] = r.String()
+		}
+		return newError(PhaseRead, nil, fmt.Errorf("%w: %s", ErrInvalidMigration, strings.Join(list, "; ")))
+	}
+	for _, r := range o.Rejected {
+		attrs := []any{"file", r.File, "reason", string(r.Reason)}
+		if r.Err != nil {
+			attrs = append(attrs, "error", r.Err)
+		}
+		o.log().Warn("Skipping", attrs...)
+	}
+	return nil
+}
+
+// Validate reads the migrations directory without touching the database and
+// returns the files that are not loaded as migrations.
+func (o *IMigrator) Validate() ([]Rejection, error) {
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	o.setupDone = true
+	return o.Rejected, nil
+}